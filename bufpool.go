@@ -0,0 +1,349 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// size classes of BufferPool, powers of two
+const (
+	minBufferClass = 9  // 512 B
+	maxBufferClass = 20 // 1 MiB
+
+	defaultBufferPoolIdle = 64 << 20 // 64 MiB
+	defaultBufferSize     = 4096     // like the bufio
+)
+
+// DefaultBufferPool is shared BufferPool with default memory cap
+var DefaultBufferPool = NewBufferPool(Default)
+
+// A BufferPool is size-classed pool of byte buffers, that can be
+// shared between servers. Buffers are rounded up to powers of two
+// from 512 B to 1 MiB, larger buffers are not pooled. A BufferPool
+// is safe for concurrent use
+type BufferPool struct {
+	// atomic counters, keep them first for 64-bit alignment
+	gets, puts, allocs, dropped uint64
+	inUse, idle                 int64
+
+	maxIdle int64 // memory cap, bytes
+	classes [maxBufferClass - minBufferClass + 1]bufferClass
+}
+
+// a bufferClass is free list of buffers of the same size
+type bufferClass struct {
+	mu   sync.Mutex
+	free [][]byte
+}
+
+// A BufferPoolStats is statistics of a BufferPool
+type BufferPoolStats struct {
+	Gets    uint64 // buffers borrowed
+	Puts    uint64 // buffers returned
+	Allocs  uint64 // buffers allocated, because the pool was empty
+	Dropped uint64 // buffers dropped, because of the memory cap
+	InUse   int64  // bytes borrowed and not returned yet
+	Idle    int64  // bytes kept by the pool
+}
+
+// NewBufferPool creates BufferPool that keeps up to maxIdle bytes of
+// free buffers, returned buffers over the cap are left to the GC. Use
+// Default for 64 MiB or No for no cap
+func NewBufferPool(maxIdle int) *BufferPool {
+	debugf("NewBufferPool: %d", maxIdle)
+	var p = new(BufferPool)
+	switch {
+	case maxIdle == Default:
+		p.maxIdle = defaultBufferPoolIdle
+	case maxIdle < 0:
+		p.maxIdle = -1 // no cap
+	default:
+		p.maxIdle = int64(maxIdle)
+	}
+	return p
+}
+
+// class of given size, the ok is false if the size is too big
+func bufferClassOf(size int) (class int, ok bool) {
+	if size <= 1<<minBufferClass {
+		return 0, true
+	}
+	class = bits.Len(uint(size-1)) - minBufferClass
+	return class, class <= maxBufferClass-minBufferClass
+}
+
+// Get borrows buffer of given size, its capacity can be greater
+func (p *BufferPool) Get(size int) (b []byte) {
+	atomic.AddUint64(&p.gets, 1)
+	class, ok := bufferClassOf(size)
+	if !ok {
+		atomic.AddUint64(&p.allocs, 1)
+		atomic.AddInt64(&p.inUse, int64(size))
+		return make([]byte, size)
+	}
+	bc := &p.classes[class]
+	bc.mu.Lock()
+	if last := len(bc.free) - 1; last >= 0 {
+		b, bc.free[last] = bc.free[last], nil
+		bc.free = bc.free[:last]
+	}
+	bc.mu.Unlock()
+	if b == nil {
+		atomic.AddUint64(&p.allocs, 1)
+		b = make([]byte, 1<<(class+minBufferClass))
+	} else {
+		atomic.AddInt64(&p.idle, -int64(cap(b)))
+	}
+	atomic.AddInt64(&p.inUse, int64(cap(b)))
+	return b[:size]
+}
+
+// Put returns buffer borrowed by the Get. The buffer must not be
+// used after that
+func (p *BufferPool) Put(b []byte) {
+	atomic.AddUint64(&p.puts, 1)
+	var size = cap(b)
+	atomic.AddInt64(&p.inUse, -int64(size))
+	class, ok := bufferClassOf(size)
+	if !ok || size != 1<<(class+minBufferClass) {
+		return // not pooled
+	}
+	if idle := atomic.AddInt64(&p.idle, int64(size)); p.maxIdle >= 0 &&
+		idle > p.maxIdle {
+
+		atomic.AddInt64(&p.idle, -int64(size))
+		atomic.AddUint64(&p.dropped, 1)
+		return
+	}
+	bc := &p.classes[class]
+	bc.mu.Lock()
+	bc.free = append(bc.free, b[:size])
+	bc.mu.Unlock()
+}
+
+// Stats returns statistics of the pool
+func (p *BufferPool) Stats() BufferPoolStats {
+	debugf("(*BufferPool).Stats")
+	return BufferPoolStats{
+		Gets:    atomic.LoadUint64(&p.gets),
+		Puts:    atomic.LoadUint64(&p.puts),
+		Allocs:  atomic.LoadUint64(&p.allocs),
+		Dropped: atomic.LoadUint64(&p.dropped),
+		InUse:   atomic.LoadInt64(&p.inUse),
+		Idle:    atomic.LoadInt64(&p.idle),
+	}
+}
+
+// size of buffer by (*Server).ReadBufferSize or WriteBufferSize
+func bufferSize(size int) int {
+	if size == Default {
+		return defaultBufferSize
+	}
+	return size
+}
+
+// a lazyReader is buffered reader that borrows its buffer from a
+// BufferPool on read and returns it when all buffered data consumed.
+// For raw connections the buffer is borrowed only when the connection
+// is readable, so a reader waiting for data doesn't hold it
+type lazyReader struct {
+	rd   io.Reader
+	rc   syscall.RawConn // if the rd can be read when it's readable
+	pool *BufferPool
+	size int
+	buf  []byte
+	r, w int   // read and write positions in the buf
+	err  error // read error delayed, because of buffered data
+}
+
+// reset the reader, returning its buffer
+func (l *lazyReader) reset(rd io.Reader, pool *BufferPool, size int) {
+	l.release()
+	l.rd, l.rc, l.pool, l.size, l.err = rd, nil, pool, size, nil
+	if conn, ok := rd.(net.Conn); ok && rawRead {
+		l.rc, _ = rawConn(conn)
+	}
+}
+
+// return the buffer to the pool
+func (l *lazyReader) release() {
+	if l.buf != nil {
+		l.pool.Put(l.buf)
+		l.buf = nil
+	}
+	l.r, l.w = 0, 0
+}
+
+// Buffered returns number of bytes that can be read from the buffer
+func (l *lazyReader) Buffered() int {
+	return l.w - l.r
+}
+
+// fill the empty buffer by one read, the buffer is released if
+// nothing is read
+func (l *lazyReader) fill() (err error) {
+	if err = l.err; err != nil {
+		l.err = nil
+		return
+	}
+	var n int
+	if l.rc != nil {
+		n, err = l.readRaw()
+	} else {
+		if l.buf == nil {
+			l.buf = l.pool.Get(l.size)
+		}
+		n, err = l.rd.Read(l.buf)
+	}
+	if n <= 0 {
+		l.release()
+		return
+	}
+	l.r, l.w, l.err = 0, n, err
+	return nil
+}
+
+// Peek returns next n buffered bytes without advancing the reader,
+// empty buffer is filled first
+func (l *lazyReader) Peek(n int) ([]byte, error) {
+	if n > 0 && l.r == l.w {
+		if err := l.fill(); l.r == l.w {
+			if err == nil {
+				err = io.ErrNoProgress
+			}
+			return nil, err
+		}
+	}
+	if n > l.Buffered() {
+		return nil, errors.New("peek: not enough buffered data")
+	}
+	return l.buf[l.r : l.r+n], nil
+}
+
+// Discard skips next n buffered bytes
+func (l *lazyReader) Discard(n int) (int, error) {
+	if n > l.Buffered() {
+		n = l.Buffered()
+	}
+	if l.r += n; l.r == l.w {
+		l.release()
+	}
+	return n, nil
+}
+
+// Read implements io.Reader interface
+func (l *lazyReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return
+	}
+	if l.r == l.w {
+		if l.err == nil && len(p) >= l.size {
+			return l.rd.Read(p) // large read, don't buffer
+		}
+		if err = l.fill(); l.r == l.w {
+			return 0, err
+		}
+	}
+	n = copy(p, l.buf[l.r:l.w])
+	l.Discard(n)
+	return n, nil
+}
+
+// a lazyWriter is buffered writer that borrows its buffer from a
+// BufferPool on write and returns it on flush
+type lazyWriter struct {
+	wr   io.Writer
+	pool *BufferPool
+	size int
+	buf  []byte
+	n    int // buffered
+}
+
+// reset the writer, buffered data is discarded
+func (l *lazyWriter) reset(wr io.Writer, pool *BufferPool, size int) {
+	l.n = 0
+	l.release()
+	l.wr, l.pool, l.size = wr, pool, size
+}
+
+// return the buffer to the pool if it's empty
+func (l *lazyWriter) release() {
+	if l.buf != nil && l.n == 0 {
+		l.pool.Put(l.buf)
+		l.buf = nil
+	}
+}
+
+// Buffered returns number of bytes written to the buffer
+func (l *lazyWriter) Buffered() int {
+	return l.n
+}
+
+// Write implements io.Writer interface
+func (l *lazyWriter) Write(p []byte) (nn int, err error) {
+	for len(p) > 0 {
+		if l.n == 0 && len(p) >= l.size {
+			var n int
+			n, err = l.wr.Write(p) // large write, don't buffer
+			return nn + n, err
+		}
+		if l.buf == nil {
+			l.buf = l.pool.Get(l.size)
+		}
+		n := copy(l.buf[l.n:], p)
+		l.n, nn, p = l.n+n, nn+n, p[n:]
+		if l.n == len(l.buf) {
+			if err = l.Flush(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Flush writes buffered data and returns the buffer to the pool
+func (l *lazyWriter) Flush() (err error) {
+	if l.n == 0 {
+		l.release()
+		return
+	}
+	n, err := l.wr.Write(l.buf[:l.n])
+	if n < l.n && err == nil {
+		err = io.ErrShortWrite
+	}
+	if n > 0 {
+		l.n = copy(l.buf, l.buf[n:l.n])
+	}
+	l.release()
+	return
+}
@@ -0,0 +1,277 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing/iotest"
+	"time"
+)
+
+func TestBufferPool(t *testing.T) {
+	p := NewBufferPool(3 * 1024)
+	a, b := p.Get(1000), p.Get(100)
+	if len(a) != 1000 || cap(a) != 1024 {
+		t.Errorf("wrong buffer: %d, %d", len(a), cap(a))
+	}
+	if len(b) != 100 || cap(b) != 512 {
+		t.Errorf("wrong buffer: %d, %d", len(b), cap(b))
+	}
+	huge := p.Get(2 << 20) // not pooled
+	if st := p.Stats(); st.InUse != 1024+512+2<<20 || st.Allocs != 3 {
+		t.Errorf("wrong stats: %+v", st)
+	}
+	p.Put(a)
+	p.Put(b)
+	p.Put(huge)
+	if st := p.Stats(); st.InUse != 0 || st.Idle != 1024+512 {
+		t.Errorf("wrong stats: %+v", st)
+	}
+	// reused
+	if c := p.Get(1024); cap(c) != 1024 || &c[0] != &a[0] {
+		t.Error("buffer is not reused")
+	} else {
+		p.Put(c)
+	}
+	// the cap
+	var bufs [][]byte
+	for i := 0; i < 4; i++ {
+		bufs = append(bufs, p.Get(1024))
+	}
+	for _, buf := range bufs {
+		p.Put(buf)
+	}
+	st := p.Stats()
+	if st.Idle > 3*1024 || st.Dropped == 0 {
+		t.Errorf("the cap is not applied: %+v", st)
+	}
+	if st.Gets != st.Puts {
+		t.Errorf("wrong stats: %+v", st)
+	}
+}
+
+func TestBufferPool_concurrent(t *testing.T) {
+	var (
+		p  = NewBufferPool(No)
+		wg sync.WaitGroup
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				p.Put(p.Get(512 << (j % 4)))
+			}
+		}(i)
+	}
+	wg.Wait()
+	if st := p.Stats(); st.InUse != 0 || st.Gets != 8000 {
+		t.Errorf("wrong stats: %+v", st)
+	}
+}
+
+func Test_lazyReader(t *testing.T) {
+	var (
+		p    = NewBufferPool(No)
+		data = strings.Repeat("0123456789", 100)
+		l    lazyReader
+	)
+	l.reset(iotest.HalfReader(strings.NewReader(data)), p, 64)
+	var (
+		got bytes.Buffer
+		buf = make([]byte, 7)
+	)
+	for {
+		n, err := l.Read(buf)
+		got.Write(buf[:n])
+		if l.Buffered() == 0 && p.Stats().InUse != 0 {
+			t.Fatal("empty buffer is not returned")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got.String() != data {
+		t.Error("wrong data read")
+	}
+	// large reads are not buffered
+	l.reset(strings.NewReader(data), p, 64)
+	if n, err := l.Read(make([]byte, 128)); n != 128 || err != nil {
+		t.Errorf("unexpected read: %d, %v", n, err)
+	}
+	if l.buf != nil {
+		t.Error("buffer borrowed for large read")
+	}
+	// peek and reset
+	l.Read(buf)
+	if p, err := l.Peek(l.Buffered()); err != nil ||
+		string(p) != data[135:192] {
+		t.Errorf("unexpected peek: %q, %v", p, err)
+	}
+	l.reset(nil, nil, 0)
+	if st := p.Stats(); st.InUse != 0 {
+		t.Errorf("buffer is not returned: %+v", st)
+	}
+}
+
+func Test_lazyWriter(t *testing.T) {
+	var (
+		p   = NewBufferPool(No)
+		out bytes.Buffer
+		l   lazyWriter
+	)
+	l.reset(&out, p, 64)
+	for i := 0; i < 100; i++ {
+		if _, err := io.WriteString(&l, "0123456789"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != strings.Repeat("0123456789", 100) {
+		t.Error("wrong data written")
+	}
+	if st := p.Stats(); st.InUse != 0 {
+		t.Errorf("buffer is not returned: %+v", st)
+	}
+	// large writes are not buffered
+	out.Reset()
+	l.Write(make([]byte, 100))
+	if l.buf != nil || out.Len() != 100 {
+		t.Error("large write is buffered")
+	}
+}
+
+// stats of the pool after a reader started waiting for data, the
+// buffer can be borrowed for a moment to check the connection
+func idleStats(p *BufferPool) (st BufferPoolStats) {
+	for i := 0; i < 100; i++ {
+		if st = p.Stats(); st.InUse == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return
+}
+
+func TestServer_BufferPool(t *testing.T) {
+	var (
+		p       = NewBufferPool(Default)
+		reading = make(chan struct{}, 1)
+		g       Grace
+	)
+	g.ServeAll(&Server{
+		BufferPool: p,
+		Handlers: []Handler{func(ctx *Context) {
+			var buf [5]byte
+			for {
+				reading <- struct{}{}
+				if _, err := io.ReadFull(ctx, buf[:]); err != nil {
+					return
+				}
+				ctx.Write(buf[:])
+				ctx.Flush()
+			}
+		}},
+		ErrorLog: discardLogger(),
+	}, mustListen(t, "tcp", "127.0.0.1:0"))
+	defer g.Close()
+	conn, err := net.Dial("tcp", g.ls[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	<-reading
+	// idle connection holds no buffers
+	if st := idleStats(p); st.InUse != 0 {
+		t.Errorf("idle connection holds buffers: %+v", st)
+	}
+	for i := 0; i < 3; i++ {
+		conn.Write([]byte("hello"))
+		var reply = make([]byte, 5)
+		if _, err = io.ReadFull(conn, reply); err != nil ||
+			string(reply) != "hello" {
+			t.Fatalf("unexpected reply: %q, %v", reply, err)
+		}
+		<-reading
+		if st := idleStats(p); st.InUse != 0 {
+			t.Errorf("idle connection holds buffers: %+v", st)
+		}
+	}
+	if st := p.Stats(); st.Gets == 0 {
+		t.Errorf("the pool is not used: %+v", st)
+	}
+}
+
+// upper cases read data
+type upperConn struct {
+	*net.TCPConn
+}
+
+func (u upperConn) Read(p []byte) (n int, err error) {
+	n, err = u.TCPConn.Read(p)
+	copy(p, bytes.ToUpper(p[:n]))
+	return
+}
+
+func Test_lazyReader_wrapper(t *testing.T) {
+	var l = mustListen(t, "tcp", "127.0.0.1:0")
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var lr lazyReader
+	defer lr.reset(nil, nil, 0)
+	// the Read of the wrapper is not bypassed
+	lr.reset(&limitConn{Conn: upperConn{conn.(*net.TCPConn)}},
+		NewBufferPool(No), 64)
+	if lr.rc != nil {
+		t.Error("wrapper is read raw")
+	}
+	io.WriteString(client, "abc")
+	var buf = make([]byte, 3)
+	if _, err = io.ReadFull(&lr, buf); err != nil || string(buf) != "ABC" {
+		t.Errorf("unexpected read: %q, %v", buf, err)
+	}
+}
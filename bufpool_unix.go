@@ -0,0 +1,69 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+//go:build unix
+
+package gtss
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// the lazyReader reads raw connections
+const rawRead = true
+
+// read to the buffer when the raw connection is readable, the buffer
+// is borrowed only when there is data; deadlines are respected
+func (l *lazyReader) readRaw() (n int, err error) {
+	var rerr error
+	err = l.rc.Read(func(fd uintptr) bool {
+		if l.buf == nil {
+			l.buf = l.pool.Get(l.size)
+		}
+		for {
+			if n, rerr = syscall.Read(int(fd), l.buf); rerr != syscall.EINTR {
+				break
+			}
+		}
+		if rerr == syscall.EAGAIN {
+			l.release() // wait without the buffer
+			return false
+		}
+		return true
+	})
+	switch {
+	case err != nil:
+	case rerr != nil:
+		err = os.NewSyscallError("read", rerr)
+	case n == 0:
+		err = io.EOF
+	}
+	if n < 0 {
+		n = 0
+	}
+	return
+}
@@ -0,0 +1,232 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A CertManager holds TLS certificate loaded from files and
+// reloads it on demand, on signal or if the files changed. Use
+// its GetCertificate method in (*Server).TLSConfig. If a new
+// certificate fails to load, the old one is kept. Create a
+// CertManager using NewCertManager
+type CertManager struct {
+	// Logger is optional logger for reloading errors. If nil,
+	// slog.Default() is used
+	Logger *slog.Logger
+
+	certFile, keyFile string
+	cert              atomic.Value // *tls.Certificate
+
+	mu      sync.Mutex // reloading and stat
+	stat    [2]os.FileInfo
+	closed  chan struct{}
+	closing sync.Once
+}
+
+// NewCertManager loads certificate and key from given files
+func NewCertManager(certFile, keyFile string) (cm *CertManager, err error) {
+	debugf("NewCertManager: %s, %s", certFile, keyFile)
+	cm = &CertManager{
+		certFile: certFile,
+		keyFile:  keyFile,
+		closed:   make(chan struct{}),
+	}
+	if err = cm.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// load and check certificate and key
+func loadKeyPair(certFile, keyFile string) (cert tls.Certificate,
+	err error) {
+
+	debugf("loadKeyPair")
+	if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return
+	}
+	if len(cert.Certificate) == 0 {
+		err = errors.New("no certificate")
+		return
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return
+		}
+	}
+	if now := time.Now(); now.After(cert.Leaf.NotAfter) {
+		err = fmt.Errorf("certificate expired at %v", cert.Leaf.NotAfter)
+	} else if now.Before(cert.Leaf.NotBefore) {
+		err = fmt.Errorf("certificate is not valid before %v",
+			cert.Leaf.NotBefore)
+	}
+	return
+}
+
+// stat files, must be called under lock
+func (c *CertManager) statFiles() (stat [2]os.FileInfo, err error) {
+	if stat[0], err = os.Stat(c.certFile); err != nil {
+		return
+	}
+	stat[1], err = os.Stat(c.keyFile)
+	return
+}
+
+// Reload loads certificate and key from the files. If the files
+// can't be loaded, or the key doesn't match the certificate, or the
+// certificate is expired, the current certificate is kept and an
+// error returned
+func (c *CertManager) Reload() (err error) {
+	debugf("(*CertManager).Reload")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var stat [2]os.FileInfo
+	if stat, err = c.statFiles(); err != nil {
+		return
+	}
+	var cert tls.Certificate
+	if cert, err = loadKeyPair(c.certFile, c.keyFile); err != nil {
+		return
+	}
+	c.stat = stat
+	c.cert.Store(&cert)
+	return
+}
+
+// Certificate returns current certificate
+func (c *CertManager) Certificate() *tls.Certificate {
+	debugf("(*CertManager).Certificate")
+	cert, _ := c.cert.Load().(*tls.Certificate)
+	return cert
+}
+
+// GetCertificate returns current certificate. It's suitable for
+// tls.Config.GetCertificate
+func (c *CertManager) GetCertificate(*tls.ClientHelloInfo) (
+	*tls.Certificate, error) {
+
+	debugf("(*CertManager).GetCertificate")
+	return c.Certificate(), nil
+}
+
+// log reloading error
+func (c *CertManager) logError(msg string, err error) {
+	var l = c.Logger
+	if l == nil {
+		l = slog.Default()
+	}
+	l.Error(msg, "cert_file", c.certFile, "key_file", c.keyFile,
+		"error", err)
+}
+
+// is any of the files changed since last reload
+func (c *CertManager) changed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stat, err := c.statFiles()
+	if err != nil {
+		return false // keep current, file can be replaced right now
+	}
+	for i, fi := range stat {
+		if old := c.stat[i]; old == nil || !fi.ModTime().Equal(old.ModTime()) ||
+			fi.Size() != old.Size() {
+
+			return true
+		}
+	}
+	return false
+}
+
+// Watch starts goroutine that checks modification time and size of
+// the files every interval and reloads them if changed. Reloading
+// errors are logged. Use Close to stop watching. The interval must
+// be positive
+func (c *CertManager) Watch(interval time.Duration) (err error) {
+	debugf("(*CertManager).Watch: %v", interval)
+	if interval <= 0 {
+		return fmt.Errorf("non-positive (*CertManager).Watch interval: %s",
+			interval)
+	}
+	go func() {
+		var ticker = time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if !c.changed() {
+					continue
+				}
+				if err := c.Reload(); err != nil {
+					c.logError("reloading certificate", err)
+				}
+			case <-c.closed:
+				return
+			}
+		}
+	}()
+	return
+}
+
+// ReloadOn starts goroutine that reloads the files on given signals,
+// usually syscall.SIGHUP. Reloading errors are logged. Use Close to
+// stop it
+func (c *CertManager) ReloadOn(sig ...os.Signal) {
+	debugf("(*CertManager).ReloadOn: %v", sig)
+	var sigc = make(chan os.Signal, 1)
+	signal.Notify(sigc, sig...)
+	go func() {
+		defer signal.Stop(sigc)
+		for {
+			select {
+			case <-sigc:
+				if err := c.Reload(); err != nil {
+					c.logError("reloading certificate", err)
+				}
+			case <-c.closed:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops all watching goroutines. The current certificate is
+// still available
+func (c *CertManager) Close() error {
+	debugf("(*CertManager).Close")
+	c.closing.Do(func() { close(c.closed) })
+	return nil
+}
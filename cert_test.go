@@ -0,0 +1,140 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// generate self-signed certificate and key in PEM
+func genCert(t *testing.T, cn string, notAfter time.Time) (cert,
+	key []byte) {
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		DNSNames:     []string{cn},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl,
+		&priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	key = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder})
+	return
+}
+
+func writeCert(t *testing.T, dir string, cert, key []byte) (cf, kf string) {
+	cf, kf = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(cf, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(kf, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func certCN(cm *CertManager) string {
+	cert, _ := cm.GetCertificate(&tls.ClientHelloInfo{})
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertManager(t *testing.T) {
+	dir := t.TempDir()
+	year := time.Now().AddDate(1, 0, 0)
+	cert, key := genCert(t, "one", year)
+	cf, kf := writeCert(t, dir, cert, key)
+	if _, err := NewCertManager(cf, filepath.Join(dir, "none")); err == nil {
+		t.Error("missing error")
+	}
+	cm, err := NewCertManager(cf, kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+	if certCN(cm) != "one" {
+		t.Fatal("wrong certificate")
+	}
+	// mismatched key
+	cert2, key2 := genCert(t, "two", year)
+	writeCert(t, dir, cert2, key)
+	if err := cm.Reload(); err == nil {
+		t.Error("missing error")
+	}
+	// expired
+	cert3, key3 := genCert(t, "three", time.Now().Add(-time.Minute))
+	writeCert(t, dir, cert3, key3)
+	if err := cm.Reload(); err == nil {
+		t.Error("missing error")
+	}
+	if certCN(cm) != "one" {
+		t.Error("failed certificate is used")
+	}
+	// watch
+	cm.Logger = discardSlog()
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if err := cm.Watch(interval); err == nil {
+			t.Errorf("missing error for %s", interval)
+		}
+	}
+	if err := cm.Watch(time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	writeCert(t, dir, cert2, key2)
+	now := time.Now() // change modification time anyway
+	os.Chtimes(cf, now.Add(time.Second), now.Add(time.Second))
+	for deadline := time.Now().Add(5 * time.Second); certCN(cm) != "two"; {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate is not reloaded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
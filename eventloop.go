@@ -0,0 +1,58 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// number of event loops
+func (s *Server) eventLoops() (n int, err error) {
+	debugf("(*Server).eventLoops")
+	switch n = s.EventLoops; {
+	case n == Default:
+		n = runtime.NumCPU()
+	case n < 0:
+		err = fmt.Errorf("negative (*Server).EventLoops: %d", s.EventLoops)
+	}
+	return
+}
+
+// check options incompatible with the event loop mode
+func (s *Server) checkEventLoop() (err error) {
+	debugf("(*Server).checkEventLoop")
+	switch {
+	case s.PoolWorkers > 0:
+		err = errors.New("(*Server).PoolWorkers is not supported in " +
+			"event loop mode")
+	case s.ProxyProtocol:
+		err = errors.New("(*Server).ProxyProtocol is not supported in " +
+			"event loop mode")
+	}
+	return
+}
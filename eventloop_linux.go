@@ -0,0 +1,435 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+//go:build linux
+
+package gtss
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// epoll events of a connection, it's rearmed after every event
+const connEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP |
+	syscall.EPOLLONESHOT
+
+// an evConn is a connection of event loop, it has no goroutine and no
+// buffers while it's idle
+type evConn struct {
+	ctx  *Context // for whole life of the connection
+	fd   int
+	last time.Time // end of last event
+	busy bool      // handlers are running
+	hup  bool      // peer closed its side
+}
+
+// eventLoops are epoll instances of one Serve
+type eventLoops struct {
+	s     *Server
+	loops []*eventLoop
+	next  uint32 // round robin, atomic
+	wg    sync.WaitGroup
+
+	base     context.Context
+	chain    Handler
+	rbs, wbs int
+}
+
+// an eventLoop is an epoll instance with its goroutine
+type eventLoop struct {
+	ls    *eventLoops
+	epfd  int
+	wake  [2]int // pipe to wake up the epoll_wait
+	mu    sync.Mutex
+	conns map[int]*evConn
+	stop  bool
+}
+
+// start (*Server).EventLoops loops
+func (s *Server) startEventLoops(base context.Context, chain Handler, rbs,
+	wbs int) (els *eventLoops, err error) {
+
+	debugf("(*Server).startEventLoops")
+	var n int
+	if n, err = s.eventLoops(); err != nil {
+		return
+	}
+	els = &eventLoops{s: s, base: base, chain: chain, rbs: rbs, wbs: wbs}
+	for i := 0; i < n; i++ {
+		var el *eventLoop
+		if el, err = newEventLoop(els); err != nil {
+			els.stop()
+			return nil, err
+		}
+		els.loops = append(els.loops, el)
+	}
+	for _, el := range els.loops {
+		els.wg.Add(1)
+		go el.run()
+	}
+	return
+}
+
+func newEventLoop(els *eventLoops) (el *eventLoop, err error) {
+	debugf("newEventLoop")
+	el = &eventLoop{ls: els, conns: make(map[int]*evConn)}
+	if el.epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC); err != nil {
+		return nil, &net.OpError{Op: "epoll_create1", Err: err}
+	}
+	if err = syscall.Pipe2(el.wake[:],
+		syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+
+		syscall.Close(el.epfd)
+		return nil, &net.OpError{Op: "pipe2", Err: err}
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(el.wake[0])}
+	if err = syscall.EpollCtl(el.epfd, syscall.EPOLL_CTL_ADD, el.wake[0],
+		&ev); err != nil {
+
+		el.closeFDs()
+		return nil, &net.OpError{Op: "epoll_ctl", Err: err}
+	}
+	return
+}
+
+func (el *eventLoop) closeFDs() {
+	syscall.Close(el.epfd)
+	syscall.Close(el.wake[0])
+	syscall.Close(el.wake[1])
+}
+
+// raw file descriptor of the connection
+func connFD(conn net.Conn) (fd int, ok bool) {
+	rc, ok := rawConn(conn)
+	if !ok {
+		return
+	}
+	if err := rc.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return 0, false
+	}
+	return fd, true
+}
+
+// shut down connection of an event loop, the loop gets EPOLLHUP and
+// closes it; the fd is not closed here, since it can be reused while
+// it's still registered in the loop
+func shutdownConn(conn net.Conn) (err error) {
+	rc, ok := rawConn(conn)
+	if !ok {
+		return conn.Close()
+	}
+	if e := rc.Control(func(fd uintptr) {
+		err = syscall.Shutdown(int(fd), syscall.SHUT_RDWR)
+	}); e != nil {
+		return e
+	}
+	return
+}
+
+// add accepted connection to a loop, it returns false if the
+// connection can't be polled; the Context of the connection is
+// created and tracked here
+func (els *eventLoops) add(conn net.Conn, ipKey, netKey string) bool {
+	debugf("(*eventLoops).add")
+	fd, ok := connFD(conn)
+	if !ok {
+		return false
+	}
+	var (
+		s   = els.s
+		i   = atomic.AddUint32(&els.next, 1) % uint32(len(els.loops))
+		el  = els.loops[i]
+		ctx = s.createContext(els.base, conn, els.rbs, els.wbs)
+		ec  = &evConn{ctx: ctx, fd: fd, last: ctx.accepted}
+	)
+	ctx.ipKey, ctx.netKey, ctx.polled = ipKey, netKey, true
+	s.trackContext(ctx, true)
+	s.setState(ctx, StateNew)
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	if el.stop {
+		el.closeConn(ec)
+		return true
+	}
+	el.conns[fd] = ec
+	ev := syscall.EpollEvent{Events: connEvents, Fd: int32(fd)}
+	if err := syscall.EpollCtl(el.epfd, syscall.EPOLL_CTL_ADD, fd,
+		&ev); err != nil {
+
+		s.log(slog.LevelError, "epoll_ctl", ctx.logAttrs("error", err)...)
+		delete(el.conns, fd)
+		el.closeConn(ec)
+	}
+	return true
+}
+
+// stop all loops and wait for them, idle connections are closed,
+// busy are closed after their handlers
+func (els *eventLoops) stop() {
+	debugf("(*eventLoops).stop")
+	for _, el := range els.loops {
+		el.mu.Lock()
+		el.stop = true
+		el.mu.Unlock()
+		syscall.Write(el.wake[1], []byte{0})
+	}
+	els.wg.Wait()
+}
+
+// epoll_wait timeout, it's used to close idle connections
+func (el *eventLoop) timeout() (msec int) {
+	if it := el.ls.s.IdleTimeout; it > 0 {
+		if msec = int(it / 2 / time.Millisecond); msec < 1 {
+			msec = 1
+		}
+		return
+	}
+	return -1 // infinite
+}
+
+func (el *eventLoop) run() {
+	debugf("(*eventLoop).run")
+	defer el.ls.wg.Done()
+	var (
+		events = make([]syscall.EpollEvent, 128)
+		msec   = el.timeout()
+	)
+	for {
+		n, err := syscall.EpollWait(el.epfd, events, msec)
+		if err == syscall.EINTR {
+			continue // n is -1
+		}
+		if err != nil {
+			el.ls.s.log(slog.LevelError, "epoll_wait", "error", err)
+			el.shutdown()
+			return
+		}
+		for _, ev := range events[:n] {
+			if fd := int(ev.Fd); fd == el.wake[0] {
+				var buf [16]byte
+				syscall.Read(fd, buf[:])
+				continue
+			}
+			el.event(ev)
+		}
+		el.mu.Lock()
+		stop := el.stop
+		el.mu.Unlock()
+		if stop {
+			el.shutdown()
+			return
+		}
+		if msec > 0 {
+			el.closeIdle()
+		}
+	}
+}
+
+// dispatch an event
+func (el *eventLoop) event(ev syscall.EpollEvent) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	ec := el.conns[int(ev.Fd)]
+	if ec == nil || ec.busy || el.stop {
+		return
+	}
+	if ev.Events&(syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+		delete(el.conns, ec.fd)
+		el.closeConn(ec) // nothing to read
+		return
+	}
+	ec.busy = true
+	ec.hup = ev.Events&syscall.EPOLLRDHUP != 0
+	go el.ls.s.serveEvent(el, ec)
+}
+
+// close connections idle longer than the (*Server).IdleTimeout
+func (el *eventLoop) closeIdle() {
+	var deadline = time.Now().Add(-el.ls.s.IdleTimeout)
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	for fd, ec := range el.conns {
+		if !ec.busy && ec.last.Before(deadline) {
+			delete(el.conns, fd)
+			el.closeConn(ec)
+		}
+	}
+}
+
+// close idle connections and the epoll, busy connections are closed
+// after their handlers
+func (el *eventLoop) shutdown() {
+	debugf("(*eventLoop).shutdown")
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	el.stop = true
+	for fd, ec := range el.conns {
+		if !ec.busy {
+			delete(el.conns, fd)
+			el.closeConn(ec)
+		}
+	}
+	el.closeFDs()
+}
+
+// close idle connection, the fd is removed from the epoll by the
+// close; it must be called under the lock
+func (el *eventLoop) closeConn(ec *evConn) {
+	ec.ctx.Conn.Close()
+	el.ls.s.closedEvent(ec.ctx)
+}
+
+// release closed connection of an event loop and its Context
+func (s *Server) closedEvent(ctx *Context) {
+	ctx.cancel()
+	s.trackContext(ctx, false)
+	s.release(ctx.ipKey, ctx.netKey)
+	s.metrics().Closed(time.Since(ctx.accepted))
+	s.setState(ctx, StateClosed)
+	s.putContext(ctx)
+}
+
+// rearm the connection after handlers, if the loop is stopped or
+// rearming fails, the connection is forgotten and false is returned
+func (el *eventLoop) rearm(ec *evConn) bool {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	ec.busy, ec.last = false, time.Now()
+	if el.stop {
+		delete(el.conns, ec.fd)
+		return false
+	}
+	ev := syscall.EpollEvent{Events: connEvents, Fd: int32(ec.fd)}
+	if err := syscall.EpollCtl(el.epfd, syscall.EPOLL_CTL_MOD, ec.fd,
+		&ev); err != nil {
+
+		el.ls.s.log(slog.LevelError, "epoll_ctl",
+			ec.ctx.logAttrs("error", err)...)
+		el.forgetLocked(ec)
+		return false
+	}
+	return true
+}
+
+// forget closed or hijacked connection, it must be called before the
+// connection is closed, since its fd can be reused
+func (el *eventLoop) forget(ec *evConn) {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+	ec.busy = false
+	el.forgetLocked(ec)
+}
+
+func (el *eventLoop) forgetLocked(ec *evConn) {
+	if !el.stop { // the epfd is closed if stopped
+		syscall.EpollCtl(el.epfd, syscall.EPOLL_CTL_DEL, ec.fd, nil)
+	}
+	delete(el.conns, ec.fd)
+}
+
+// serve readable connection: the handlers are called while there is
+// buffered data; the connection is closed if they read nothing, since
+// it's readable yet
+func (s *Server) serveEvent(el *eventLoop, ec *evConn) {
+	debugf("(*Server).serveEvent")
+	var (
+		ctx  = ec.ctx
+		keep bool
+	)
+	defer func() {
+		if err := recover(); err != nil {
+			s.log(slog.LevelError, "panic serving",
+				ctx.logAttrs("error", err, "stack", stack())...)
+			s.metrics().Panic()
+			s.metrics().Failed()
+			keep = false
+		}
+		if keep {
+			if err := ctx.Flush(); err != nil {
+				keep = false
+			}
+		}
+		switch {
+		case ctx.hijacked:
+			el.forget(ec)
+			ctx.cancel()
+			s.release(ctx.ipKey, ctx.netKey)
+			s.putContext(ctx)
+		case keep:
+			s.setState(ctx, StateIdle)
+			if el.rearm(ec) {
+				break
+			}
+			fallthrough
+		default:
+			if !keep {
+				el.forget(ec)
+			}
+			if !ctx.closed {
+				if err := ctx.Close(); err != nil {
+					s.log(slog.LevelError, "error closing connection",
+						ctx.logAttrs("error", err)...)
+				}
+			}
+			s.closedEvent(ctx)
+		}
+	}()
+	if ctx.it > 0 {
+		ctx.lastIO = time.Now() // the idle time is over
+	}
+	s.setState(ctx, StateActive)
+	for {
+		read := atomic.LoadInt64(&ctx.nread)
+		ctx.handlers, ctx.index, ctx.aborted = s.Handlers, -1, false
+		el.ls.chain(ctx)
+		if ctx.err != nil {
+			s.handleAbort(ctx)
+			return // close
+		}
+		if ctx.closed || ctx.hijacked || ctx.aborted {
+			return // close, the context.Context is cancelled if aborted
+		}
+		if atomic.LoadInt64(&ctx.nread) == read {
+			if !ec.hup {
+				s.log(slog.LevelError, "handlers read nothing",
+					ctx.logAttrs()...)
+				s.metrics().Failed()
+			}
+			return // close, otherwise the handlers are called forever
+		}
+		if ctx.buffered() == 0 && !ec.hup {
+			keep = true
+			return
+		}
+		// if the peer closed its side, the handlers are called until
+		// they read the EOF, since the socket can hold unread data
+	}
+}
@@ -0,0 +1,51 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+//go:build !linux
+
+package gtss
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// eventLoops are not supported
+type eventLoops struct{}
+
+func (s *Server) startEventLoops(context.Context, Handler, int, int) (
+	*eventLoops, error) {
+
+	debugf("(*Server).startEventLoops")
+	return nil, errors.New("event loop mode is not supported on this " +
+		"platform")
+}
+
+func (*eventLoops) add(net.Conn, string, string) bool { return false }
+func (*eventLoops) stop()                             {}
+
+// shut down connection of an event loop, there are no such connections
+func shutdownConn(conn net.Conn) error { return conn.Close() }
@@ -0,0 +1,489 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+//go:build linux
+
+package gtss
+
+import (
+	"testing"
+
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// reads one line per call and replies with the line number of the
+// connection; "close" closes the connection. It reads byte by byte,
+// the rest is buffered by the Context
+func hEventLine(ctx *Context) {
+	var (
+		line []byte
+		b    [1]byte
+	)
+	for {
+		if _, err := io.ReadFull(ctx, b[:]); err != nil {
+			ctx.Close()
+			return
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	if string(line) == "close" {
+		ctx.Close()
+		return
+	}
+	n, _ := ctx.Get("n").(int)
+	ctx.Set("n", n+1)
+	fmt.Fprintf(ctx, "%d %s\n", n+1, line)
+}
+
+func eventServe(t *testing.T, s *Server) (g *Grace, addr string) {
+	g = new(Grace)
+	g.ServeAll(s, mustListen(t, "tcp", "127.0.0.1:0"))
+	return g, g.ls[0].Addr().String()
+}
+
+func TestServer_EventLoop(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		states []ConnState
+		g, a   = eventServe(t, &Server{
+			EventLoop:  true,
+			EventLoops: 2,
+			Handlers:   []Handler{hEventLine},
+			ConnState: func(_ net.Conn, state ConnState) {
+				mu.Lock()
+				states = append(states, state)
+				mu.Unlock()
+			},
+			ErrorLog: discardLogger(),
+		})
+	)
+	defer g.Close()
+	var conns []net.Conn
+	for i := 0; i < 10; i++ {
+		conn, err := net.Dial("tcp", a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		// many lines at once are buffered by the Context
+		if _, err := io.WriteString(conn, "a\nb\n"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, conn := range conns {
+		br := bufio.NewReader(conn)
+		for _, want := range []string{"1 a\n", "2 b\n"} {
+			if got, err := br.ReadString('\n'); err != nil || got != want {
+				t.Fatalf("unexpected reply: %q, %v", got, err)
+			}
+		}
+		// the value is kept between events
+		io.WriteString(conn, "c\n")
+		if got, err := br.ReadString('\n'); err != nil || got != "3 c\n" {
+			t.Fatalf("unexpected reply: %q, %v", got, err)
+		}
+		io.WriteString(conn, "close\n")
+		if _, err := br.ReadByte(); err != io.EOF {
+			t.Errorf("connection is not closed: %v", err)
+		}
+		conn.Close()
+	}
+	select {
+	case <-g.s.drained():
+	case <-time.After(time.Second):
+		t.Errorf("closed connections are tracked: %d", g.s.activeCount())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var count = make(map[ConnState]int)
+	for _, st := range states {
+		count[st]++
+	}
+	if count[StateNew] != 10 || count[StateIdle] < 10 {
+		t.Errorf("unexpected states: %v", count)
+	}
+}
+
+func TestServer_EventLoopShutdown(t *testing.T) {
+	var g, a = eventServe(t, &Server{
+		EventLoop: true,
+		Handlers:  []Handler{hEventLine},
+		ErrorLog:  discardLogger(),
+	})
+	conn, err := net.Dial("tcp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "a\n")
+	br := bufio.NewReader(conn)
+	if got, err := br.ReadString('\n'); err != nil || got != "1 a\n" {
+		t.Fatalf("unexpected reply: %q, %v", got, err)
+	}
+	// the idle connection is closed at once
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = g.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = br.ReadByte(); err != io.EOF {
+		t.Errorf("connection is not closed: %v", err)
+	}
+}
+
+func TestServer_EventLoopConns(t *testing.T) {
+	var (
+		cxs  = make(chan context.Context, 2)
+		g, a = eventServe(t, &Server{
+			EventLoop: true,
+			Handlers: []Handler{func(ctx *Context) {
+				cxs <- ctx.Context()
+			}, hEventLine},
+			ErrorLog: discardLogger(),
+		})
+	)
+	defer g.Close()
+	conn, err := net.Dial("tcp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(conn)
+	for i, line := range []string{"a", "b"} {
+		io.WriteString(conn, line+"\n")
+		want := fmt.Sprintf("%d %s\n", i+1, line)
+		if got, err := br.ReadString('\n'); err != nil || got != want {
+			t.Fatalf("unexpected reply: %q, %v", got, err)
+		}
+	}
+	if cx := <-cxs; cx != <-cxs {
+		t.Error("new context.Context per event")
+	}
+	// the idle connection is listed and can be closed
+	var cs []ConnInfo
+	for i := 0; i < 100; i++ {
+		if cs = g.s.Conns(); len(cs) == 1 && cs[0].State == StateIdle {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(cs) != 1 || cs[0].State != StateIdle || cs[0].BytesRead != 4 {
+		t.Fatalf("unexpected connections: %+v", cs)
+	}
+	if err = g.s.CloseConn(cs[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = br.ReadByte(); err != io.EOF {
+		t.Errorf("connection is not closed: %v", err)
+	}
+	select {
+	case <-g.s.drained():
+	case <-time.After(time.Second):
+		t.Errorf("closed connection is tracked: %d", g.s.activeCount())
+	}
+}
+
+func TestServer_EventLoopReadNothing(t *testing.T) {
+	var (
+		logs  syncBuffer
+		calls int32
+		g, a  = eventServe(t, &Server{
+			EventLoop: true,
+			Handlers: []Handler{func(*Context) {
+				atomic.AddInt32(&calls, 1)
+			}},
+			Logger: slog.New(slog.NewTextHandler(&logs, nil)),
+		})
+	)
+	defer g.Close()
+	conn, err := net.Dial("tcp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "a\n")
+	// unread data makes it reset
+	if _, err = conn.Read(make([]byte, 1)); err == nil ||
+		errors.Is(err, os.ErrDeadlineExceeded) {
+
+		t.Errorf("connection is not closed: %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("handlers are called %d times", n)
+	}
+	if !strings.Contains(logs.String(), "handlers read nothing") {
+		t.Errorf("missing log: %q", logs.String())
+	}
+}
+
+func TestServer_EventLoopSignals(t *testing.T) {
+	var sigc = make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGUSR1)
+	defer signal.Stop(sigc)
+	var g, a = eventServe(t, &Server{
+		EventLoop:  true,
+		EventLoops: 4,
+		Handlers:   []Handler{hEventLine},
+		ErrorLog:   discardLogger(),
+	})
+	defer g.Close()
+	// epoll_wait of the loops is interrupted, the signal is sent to
+	// every thread, since the waiting ones are not chosen otherwise
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		tasks, err := os.ReadDir("/proc/self/task")
+		if err != nil {
+			t.Skip(err)
+		}
+		for _, task := range tasks {
+			if tid, err := strconv.Atoi(task.Name()); err == nil {
+				syscall.Tgkill(os.Getpid(), tid, syscall.SIGUSR1)
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	conn, err := net.Dial("tcp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "a\n")
+	got, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || got != "1 a\n" {
+		t.Fatalf("unexpected reply: %q, %v", got, err)
+	}
+}
+
+func TestServer_EventLoopAbort(t *testing.T) {
+	var g, a = eventServe(t, &Server{
+		EventLoop: true,
+		Handlers: []Handler{hEventLine, func(ctx *Context) {
+			ctx.Abort()
+		}},
+		ErrorLog: discardLogger(),
+	})
+	defer g.Close()
+	conn, err := net.Dial("tcp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	io.WriteString(conn, "a\n")
+	br := bufio.NewReader(conn)
+	if got, err := br.ReadString('\n'); err != nil || got != "1 a\n" {
+		t.Fatalf("unexpected reply: %q, %v", got, err)
+	}
+	// the cancelled context.Context is not used for next messages
+	if _, err = br.ReadByte(); err != io.EOF {
+		t.Errorf("aborted connection is not closed: %v", err)
+	}
+}
+
+func TestServer_EventLoopCloseWrite(t *testing.T) {
+	var g, a = eventServe(t, &Server{
+		EventLoop: true,
+		Handlers:  []Handler{hEventLine},
+		ErrorLog:  discardLogger(),
+	})
+	defer g.Close()
+	conn, err := net.Dial("tcp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	const lines = 2000
+	go func() {
+		io.WriteString(conn, strings.Repeat("0123456789abcde\n", lines))
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	var (
+		sc = bufio.NewScanner(conn)
+		n  int
+	)
+	for sc.Scan() {
+		n++
+	}
+	if err = sc.Err(); err != nil {
+		t.Error(err)
+	}
+	if n != lines {
+		t.Errorf("handled %d lines of %d", n, lines)
+	}
+}
+
+func TestServer_EventLoopIdleTimeout(t *testing.T) {
+	var g, a = eventServe(t, &Server{
+		EventLoop:   true,
+		IdleTimeout: 50 * time.Millisecond,
+		Handlers:    []Handler{hEventLine},
+		ErrorLog:    discardLogger(),
+	})
+	defer g.Close()
+	conn, err := net.Dial("tcp", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("idle connection is not closed: %v", err)
+	}
+}
+
+func TestServer_EventLoopTLS(t *testing.T) {
+	var g Grace
+	g.ServeAll(&Server{
+		EventLoop: true,
+		Handlers: []Handler{func(ctx *Context) {
+			ctx.Write([]byte("ok"))
+		}},
+		ErrorLog: discardLogger(),
+	}, tls.NewListener(mustListen(t, "tcp", "127.0.0.1:0"), tlsConfig(t)))
+	defer g.Close()
+	conn, err := tls.Dial("tcp", g.ls[0].Addr().String(),
+		&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if reply, err := io.ReadAll(conn); err != nil || string(reply) != "ok" {
+		t.Errorf("unexpected reply: %q, %v", reply, err)
+	}
+}
+
+func TestServer_EventLoopErrors(t *testing.T) {
+	for _, s := range []*Server{
+		{EventLoop: true, EventLoops: -1},
+		{EventLoop: true, PoolWorkers: 1},
+		{EventLoop: true, ProxyProtocol: true,
+			ProxyTrustedCIDRs: []string{"127.0.0.0/8"}},
+	} {
+		err := s.Serve(mustListen(t, "tcp", "127.0.0.1:0"))
+		if err == nil || strings.Contains(err.Error(), "closed") {
+			t.Errorf("missing error: %v", err)
+		}
+	}
+}
+
+// idle connections and one active, the memory per connection
+// is reported
+func benchmarkIdle(b *testing.B, eventLoop bool) {
+	const idle = 2000
+	var g Grace
+	g.ServeAll(&Server{
+		EventLoop: eventLoop,
+		Handlers: []Handler{func(ctx *Context) {
+			var buf [5]byte
+			for {
+				if _, err := io.ReadFull(ctx, buf[:]); err != nil {
+					return
+				}
+				ctx.Write(buf[:])
+				ctx.Flush()
+				if eventLoop {
+					return // next event
+				}
+			}
+		}},
+		ErrorLog: discardLogger(),
+	}, mustListen(b, "tcp", "127.0.0.1:0"))
+	// the connections are closed first, and the next run measures
+	// nothing left by this one
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			5*time.Second)
+		defer cancel()
+		g.Shutdown(ctx)
+	}()
+	addr := g.ls[0].Addr().String()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	var conns []net.Conn
+	for i := 0; i < idle; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Skipf("can't open %d connections: %v", idle, err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	// wait for all connections to be accepted
+	conns[idle-1].Write([]byte("hello"))
+	conns[idle-1].Read(make([]byte, 5))
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	// live heap and stacks, signed, since the heap can shrink
+	var perConn = float64(int64(after.HeapAlloc+after.StackInuse)-
+		int64(before.HeapAlloc+before.StackInuse)) / idle
+
+	var (
+		conn = conns[0]
+		buf  = make([]byte, 5)
+	)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(perConn, "B/conn")
+}
+
+func BenchmarkServe_idle(b *testing.B)          { benchmarkIdle(b, false) }
+func BenchmarkServe_idleEventLoop(b *testing.B) { benchmarkIdle(b, true) }
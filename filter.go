@@ -0,0 +1,175 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// An IPFilter is an immutable list of allowed and denied networks.
+// A denied network wins. If the allow list is empty, any address that
+// is not denied is allowed. Addresses that are not IP (unix sockets,
+// for example) are not filtered
+type IPFilter struct {
+	allow, deny []*net.IPNet
+}
+
+// parse CIDR or single IP address
+func parseCIDRs(cidrs []string) (ns []*net.IPNet, err error) {
+	debugf("parseCIDRs")
+	ns = make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ns = append(ns, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		var n *net.IPNet
+		if _, n, err = net.ParseCIDR(cidr); err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return
+}
+
+// NewIPFilter creates IPFilter by given lists of CIDRs, like
+// "10.0.0.0/8" or "2001:db8::/32". Single IP addresses are also
+// allowed
+func NewIPFilter(allow, deny []string) (f *IPFilter, err error) {
+	debugf("NewIPFilter")
+	f = new(IPFilter)
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func containsIP(ns []*net.IPNet, ip net.IP) bool {
+	for _, n := range ns {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow reports whether the addr is allowed by the filter. Nil
+// IPFilter allows everything
+func (f *IPFilter) Allow(addr net.Addr) bool {
+	debugf("(*IPFilter).Allow: %v", addr)
+	if f == nil {
+		return true
+	}
+	var ip = addrIP(addr)
+	if ip == nil {
+		return true // not an IP address
+	}
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+// SetIPFilter replaces IP filter of the server. It's safe to call the
+// SetIPFilter at runtime, the new filter is used for next accepted
+// connections. Nil removes the filter
+func (s *Server) SetIPFilter(f *IPFilter) {
+	debugf("(*Server).SetIPFilter")
+	s.ipFilter.Store(f)
+}
+
+// IPFilter returns current IP filter of the server or nil
+func (s *Server) IPFilter() (f *IPFilter) {
+	debugf("(*Server).IPFilter")
+	f, _ = s.ipFilter.Load().(*IPFilter)
+	return
+}
+
+// initialize the IP filter from AllowCIDRs and DenyCIDRs
+// if it's not set yet
+func (s *Server) initIPFilter() (err error) {
+	debugf("(*Server).initIPFilter")
+	if s.ipFilter.Load() != nil {
+		return // already set
+	}
+	if len(s.AllowCIDRs) == 0 && len(s.DenyCIDRs) == 0 {
+		return
+	}
+	var f *IPFilter
+	if f, err = NewIPFilter(s.AllowCIDRs, s.DenyCIDRs); err != nil {
+		return fmt.Errorf("(*Server).AllowCIDRs or DenyCIDRs: %v", err)
+	}
+	s.SetIPFilter(f)
+	return
+}
+
+// is the addr allowed by the AcceptFilter and IP filter
+func (s *Server) allow(addr net.Addr) bool {
+	debugf("(*Server).allow: %v", addr)
+	if s.AcceptFilter != nil && !s.AcceptFilter(addr) {
+		return false
+	}
+	return s.IPFilter().Allow(addr)
+}
+
+// a filterListener drops not allowed connections before they reach
+// the workers limit and the accept loop
+type filterListener struct {
+	net.Listener
+	s *Server
+}
+
+// Accept implements net.Listener interface
+func (f *filterListener) Accept() (conn net.Conn, err error) {
+	debugf("(*filterListener).Accept")
+	for {
+		if conn, err = f.Listener.Accept(); err != nil {
+			return
+		}
+		if f.s.allow(conn.RemoteAddr()) {
+			return
+		}
+		f.s.log(slog.LevelDebug, "connection rejected",
+			"remote_addr", conn.RemoteAddr().String(),
+			"reason", "denied by filter")
+		f.s.metrics().Rejected()
+		conn.Close()
+	}
+}
@@ -0,0 +1,128 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"log"
+	"net"
+	"time"
+)
+
+func TestNewIPFilter(t *testing.T) {
+	if _, err := NewIPFilter([]string{"bad"}, nil); err == nil {
+		t.Error("missing error")
+	}
+	if _, err := NewIPFilter(nil, []string{"10.0.0.0/33"}); err == nil {
+		t.Error("missing error")
+	}
+	f, err := NewIPFilter([]string{"10.0.0.0/8", "2001:db8::/32"},
+		[]string{"10.1.0.0/16", "10.2.3.4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{
+		"10.0.0.1:1":          true,
+		"10.1.2.3:1":          false,
+		"10.2.3.4:1":          false,
+		"10.2.3.5:1":          true,
+		"192.168.0.1:1":       false,
+		"[2001:db8::1]:1":     true,
+		"[2001:db9::1]:1":     false,
+		"[::ffff:10.0.0.1]:1": true,
+	} {
+		ta, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Allow(ta); got != want {
+			t.Errorf("%s: want %v, got %v", addr, want, got)
+		}
+	}
+	if !f.Allow(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}) {
+		t.Error("not IP address is filtered")
+	}
+	if !(*IPFilter)(nil).Allow(&net.TCPAddr{IP: net.IPv4(1, 2, 3, 4)}) {
+		t.Error("nil IPFilter denies")
+	}
+}
+
+func TestServer_SetIPFilter(t *testing.T) {
+	var logs syncBuffer
+	data := []byte("Hello")
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    1,
+			ReadBufferSize:  No,
+			WriteBufferSize: No,
+			DenyCIDRs:       []string{"127.0.0.0/8"},
+			ErrorLog:        log.New(&logs, "", 0),
+			Handlers:        []Handler{hSend(data, t)},
+		}
+	})
+	defer g.Close()
+	for i := 0; i < 2; i++ { // the single slot is not used
+		reply, err := recvAll(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply) != 0 {
+			t.Errorf("denied connection is served: %q", reply)
+		}
+	}
+	if logs.String() != "" {
+		t.Errorf("denied connection is logged: %q", logs.String())
+	}
+	if g.s.IPFilter() == nil {
+		t.Fatal("missing IP filter")
+	}
+	g.s.SetIPFilter(nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reply, err := recvAll(ln.Addr().String())
+		if err != nil {
+			t.Error(err)
+		}
+		if string(reply) != string(data) {
+			t.Errorf("wrong reply: %q", reply)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("allowed connection is not served")
+	}
+}
+
+func TestServer_AcceptFilter(t *testing.T) {
+	s := Server{AcceptFilter: func(net.Addr) bool { return false }}
+	if s.allow(&net.TCPAddr{IP: net.IPv4(1, 2, 3, 4)}) {
+		t.Error("AcceptFilter is ignored")
+	}
+}
@@ -0,0 +1,207 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ErrFrameTooLarge is returned by (*Context).ReadFrame and WriteFrame
+// if a frame is larger than the (*Server).Frame.MaxSize or can't be
+// described by the length prefix
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// DefaultMaxFrameSize is default maximum size of a frame
+const DefaultMaxFrameSize = 1 << 20 // 1 MiB
+
+// FrameOptions describe length-prefixed frames of the
+// (*Context).ReadFrame and WriteFrame
+type FrameOptions struct {
+	// Prefix is size of fixed-width length prefix in bytes: 1, 2, 4 or
+	// 8. Use Default for 4. It's ignored if the Varint is set
+	Prefix int
+	// LittleEndian is byte order of the prefix, big-endian by default
+	LittleEndian bool
+	// Varint turns on unsigned varint length prefix, the same as
+	// encoding/binary uses
+	Varint bool
+	// MaxSize is maximum size of frame, excluding the prefix. Use
+	// Default for DefaultMaxFrameSize or No for no limit
+	MaxSize int
+}
+
+// check the options
+func (o *FrameOptions) check() (err error) {
+	debugf("(*FrameOptions).check")
+	switch o.Prefix {
+	case Default, 1, 2, 4, 8:
+	default:
+		err = fmt.Errorf("invalid (*Server).Frame.Prefix: %d", o.Prefix)
+		return
+	}
+	if o.MaxSize < No {
+		err = fmt.Errorf("negative (*Server).Frame.MaxSize: %d", o.MaxSize)
+	}
+	return
+}
+
+// size of fixed-width prefix
+func (o *FrameOptions) prefix() int {
+	if o.Prefix == Default {
+		return 4
+	}
+	return o.Prefix
+}
+
+// byte order of fixed-width prefix
+func (o *FrameOptions) order() binary.ByteOrder {
+	if o.LittleEndian {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// maximum size of frame, including limit of the prefix
+func (o *FrameOptions) maxSize() (max uint64) {
+	switch o.MaxSize {
+	case Default:
+		max = DefaultMaxFrameSize
+	case No:
+		max = math.MaxInt
+	default:
+		max = uint64(o.MaxSize)
+	}
+	if !o.Varint && o.prefix() < 8 {
+		if pmax := uint64(1)<<(8*o.prefix()) - 1; pmax < max {
+			max = pmax
+		}
+	}
+	return
+}
+
+// read length prefix of a frame, io.EOF is returned only if the
+// connection is closed before a frame
+func (c *Context) readFramePrefix(o *FrameOptions) (n uint64, err error) {
+	if !o.Varint {
+		var p = c.fr[:o.prefix()]
+		if _, err = io.ReadFull(c, p); err != nil {
+			return
+		}
+		switch len(p) {
+		case 1:
+			n = uint64(p[0])
+		case 2:
+			n = uint64(o.order().Uint16(p))
+		case 4:
+			n = uint64(o.order().Uint32(p))
+		default:
+			n = o.order().Uint64(p)
+		}
+		return
+	}
+	for i := range c.fr {
+		if _, err = io.ReadFull(c, c.fr[i:i+1]); err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		if c.fr[i] < 0x80 {
+			var m int
+			if n, m = binary.Uvarint(c.fr[:i+1]); m <= 0 {
+				err = ErrFrameTooLarge // overflows uint64
+			}
+			return
+		}
+	}
+	return 0, ErrFrameTooLarge // too long varint
+}
+
+// ReadFrame reads a length-prefixed frame described by the
+// (*Server).Frame. The frame is read to the buf if it has enough
+// capacity, otherwise new slice is allocated. A frame larger than the
+// MaxSize is not read and ErrFrameTooLarge is returned, the connection
+// should be closed, since it's out of sync. The io.EOF is returned only
+// if the connection is closed between frames
+func (c *Context) ReadFrame(buf []byte) (frame []byte, err error) {
+	var (
+		o = &c.srv.Frame
+		n uint64
+	)
+	if n, err = c.readFramePrefix(o); err != nil {
+		return
+	}
+	if n > o.maxSize() {
+		return nil, ErrFrameTooLarge
+	}
+	if uint64(cap(buf)) >= n {
+		frame = buf[:n]
+	} else {
+		frame = make([]byte, n)
+	}
+	if _, err = io.ReadFull(c, frame); err == io.EOF {
+		err = io.ErrUnexpectedEOF // the prefix has been read
+	}
+	if err != nil {
+		frame = nil
+	}
+	return
+}
+
+// WriteFrame writes the p as a length-prefixed frame described by the
+// (*Server).Frame. It returns ErrFrameTooLarge if the p is larger than
+// the MaxSize or than the prefix can describe. Buffered connection
+// should be flushed as usual
+func (c *Context) WriteFrame(p []byte) (err error) {
+	var o = &c.srv.Frame
+	if uint64(len(p)) > o.maxSize() {
+		return ErrFrameTooLarge
+	}
+	var prefix []byte
+	if o.Varint {
+		prefix = c.fw[:binary.PutUvarint(c.fw[:], uint64(len(p)))]
+	} else {
+		switch prefix = c.fw[:o.prefix()]; len(prefix) {
+		case 1:
+			prefix[0] = byte(len(p))
+		case 2:
+			o.order().PutUint16(prefix, uint16(len(p)))
+		case 4:
+			o.order().PutUint32(prefix, uint32(len(p)))
+		default:
+			o.order().PutUint64(prefix, uint64(len(p)))
+		}
+	}
+	if _, err = c.Write(prefix); err != nil {
+		return
+	}
+	_, err = c.Write(p)
+	return
+}
@@ -0,0 +1,193 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// echo frames, the last error is sent to the errs
+func hFrameEcho(errs chan<- error) Handler {
+	return func(ctx *Context) {
+		var buf = make([]byte, 0, 16)
+		for {
+			frame, err := ctx.ReadFrame(buf)
+			if err == nil {
+				if err = ctx.WriteFrame(frame); err == nil {
+					err = ctx.Flush()
+				}
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}
+}
+
+func TestContext_ReadFrame(t *testing.T) {
+	var (
+		long  = strings.Repeat("x", 300)
+		tests = []struct {
+			name   string
+			opts   FrameOptions
+			prefix []byte
+			data   string
+		}{
+			{"default", FrameOptions{}, []byte{0, 0, 0, 5}, "hello"},
+			{"one", FrameOptions{Prefix: 1}, []byte{5}, "hello"},
+			{"little endian", FrameOptions{Prefix: 2, LittleEndian: true},
+				[]byte{0x2c, 1}, long},
+			{"eight", FrameOptions{Prefix: 8},
+				[]byte{0, 0, 0, 0, 0, 0, 0, 5}, "hello"},
+			{"varint", FrameOptions{Varint: true}, []byte{5}, "hello"},
+			{"varint long", FrameOptions{Varint: true}, []byte{0xac, 2}, long},
+			{"empty", FrameOptions{Prefix: 2}, []byte{0, 0}, ""},
+		}
+	)
+	for _, bs := range []int{Default, No} {
+		for _, tt := range tests {
+			var (
+				errs = make(chan error, 1)
+				g    Grace
+			)
+			g.ServeAll(&Server{
+				ReadBufferSize:  bs,
+				WriteBufferSize: bs,
+				Frame:           tt.opts,
+				Handlers:        []Handler{hFrameEcho(errs)},
+				ErrorLog:        discardLogger(),
+			}, mustListen(t, "tcp", "127.0.0.1:0"))
+			conn, err := net.Dial("tcp", g.ls[0].Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.SetDeadline(time.Now().Add(time.Second))
+			var frame = append(append([]byte{}, tt.prefix...), tt.data...)
+			for i := 0; i < 2; i++ {
+				// the prefix is written separately
+				conn.Write(frame[:1])
+				conn.Write(frame[1:])
+				var reply = make([]byte, len(frame))
+				if _, err = io.ReadFull(conn, reply); err != nil {
+					t.Fatalf("%s (%d): %v", tt.name, bs, err)
+				}
+				if !bytes.Equal(reply, frame) {
+					t.Errorf("%s (%d): wrong reply %v", tt.name, bs, reply)
+				}
+			}
+			conn.Close()
+			if err = <-errs; err != io.EOF {
+				t.Errorf("%s (%d): unexpected error: %v", tt.name, bs, err)
+			}
+			g.Close()
+		}
+	}
+}
+
+func TestContext_ReadFrame_tooLarge(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		opts  FrameOptions
+		frame []byte
+	}{
+		{"max size", FrameOptions{Prefix: 1, MaxSize: 4},
+			[]byte{5, 'h', 'e', 'l', 'l', 'o'}},
+		{"varint overflow", FrameOptions{Varint: true, MaxSize: No},
+			bytes.Repeat([]byte{0xff}, 11)},
+		{"unexpected EOF", FrameOptions{Prefix: 1}, []byte{5, 'h'}},
+	} {
+		var (
+			errs = make(chan error, 1)
+			g    Grace
+		)
+		g.ServeAll(&Server{
+			Frame:    tt.opts,
+			Handlers: []Handler{hFrameEcho(errs)},
+			ErrorLog: discardLogger(),
+		}, mustListen(t, "tcp", "127.0.0.1:0"))
+		conn, err := net.Dial("tcp", g.ls[0].Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(tt.frame)
+		conn.Close()
+		var want = ErrFrameTooLarge
+		if tt.name == "unexpected EOF" {
+			want = io.ErrUnexpectedEOF
+		}
+		if err = <-errs; err != want {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		g.Close()
+	}
+}
+
+func TestContext_WriteFrame_tooLarge(t *testing.T) {
+	var (
+		errs = make(chan error, 2)
+		g    Grace
+	)
+	g.ServeAll(&Server{
+		Frame: FrameOptions{Prefix: 1, MaxSize: No},
+		Handlers: []Handler{func(ctx *Context) {
+			errs <- ctx.WriteFrame(make([]byte, 256))
+			errs <- ctx.WriteFrame(make([]byte, 255))
+		}},
+		ErrorLog: discardLogger(),
+	}, mustListen(t, "tcp", "127.0.0.1:0"))
+	defer g.Close()
+	conn, err := net.Dial("tcp", g.ls[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = <-errs; err != ErrFrameTooLarge {
+		t.Error("unexpected error:", err)
+	}
+	if err = <-errs; err != nil {
+		t.Error("unexpected error:", err)
+	}
+}
+
+func TestServer_Frame(t *testing.T) {
+	for _, opts := range []FrameOptions{
+		{Prefix: 3},
+		{Prefix: -1},
+		{MaxSize: -2},
+	} {
+		s := &Server{Frame: opts}
+		if err := s.Serve(mustListen(t, "tcp", "127.0.0.1:0")); err == nil {
+			t.Errorf("missing error for %+v", opts)
+		}
+	}
+}
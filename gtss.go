@@ -30,25 +30,21 @@ package gtss
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"golang.org/x/net/netutil"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const debug bool = false
-
-func debugf(format string, args ...interface{}) {
-	if debug {
-		log.Printf("[debug]: "+format, args...)
-	}
-}
-
 // internal defaults
 
 const (
@@ -74,26 +70,170 @@ const (
 // A Context represents buffered or not buffered
 // connection.
 type Context struct {
+	// atomic counters, keep them first for 64-bit alignment
+	nread, nwritten int64
+
 	in   io.Reader
 	out  io.Writer
 	bin  *bufio.Reader
 	bout *bufio.Writer
+	lin  *lazyReader // if the (*Server).BufferPool is used
+	lout *lazyWriter // if the (*Server).BufferPool is used
 	kv   map[interface{}]interface{}
+
+	// length prefixes of read and written frames
+	fr, fw [binary.MaxVarintLen64]byte
+	line   []byte // line of ReadLine that doesn't fit the read buffer
+
+	// timeouts
+	rt, wt, it time.Duration
+	lastIO     time.Time // last successful I/O, used if it > 0
+
+	// context.Context of the connection
+	cx     context.Context
+	cancel context.CancelFunc
+
+	// handlers chain
+	handlers []Handler
+	index    int   // current handler
+	aborted  bool  // the chain is aborted
+	err      error // abort reason
+
+	srv *Server // owner
+
+	state    int32 // ConnState, atomic
+	hijacked bool  // connection is hijacked
+	closed   bool  // closed by the Close
+	polled   bool  // served by an event loop
+
+	// introspection
+	id       uint64    // unique per server
+	accepted time.Time // accept time
+	handler  int32     // index of current handler, atomic
+
+	ipKey, netKey string // per-IP limits keys
+
+	proxy *ProxyInfo // PROXY protocol header
+
 	net.Conn
 }
 
+// deadline by given timeout and idle timeout, the earliest is used
+func (c *Context) deadline(timeout time.Duration) (t time.Time) {
+	now := time.Now()
+	if timeout > 0 {
+		t = now.Add(timeout)
+	}
+	if c.it > 0 {
+		if idle := c.lastIO.Add(c.it); t.IsZero() || idle.Before(t) {
+			t = idle
+		}
+	}
+	return
+}
+
+// refresh read deadline if need
+func (c *Context) readDeadline() (err error) {
+	if c.rt > 0 || c.it > 0 {
+		err = c.Conn.SetReadDeadline(c.deadline(c.rt))
+	}
+	return
+}
+
+// refresh write deadline if need
+func (c *Context) writeDeadline() (err error) {
+	if c.wt > 0 || c.it > 0 {
+		err = c.Conn.SetWriteDeadline(c.deadline(c.wt))
+	}
+	return
+}
+
 // Read wraps connection Read method. It refers to buffer
-// if connection is buffered
+// if connection is buffered. It refreshes read deadline if
+// (*Server).ReadTimeout or (*Server).IdleTimeout is set
 func (c *Context) Read(p []byte) (n int, err error) {
-	debugf("(*Context).Read: %v", c.RemoteAddr())
-	return c.in.Read(p)
+	if err = c.startRead(); err != nil {
+		return
+	}
+	n, err = c.in.Read(p)
+	c.doneRead(n)
+	return
+}
+
+// prepare to read, refreshing read deadline
+func (c *Context) startRead() (err error) {
+	if c.hijacked {
+		return ErrHijacked
+	}
+	if err = c.readDeadline(); err != nil {
+		return
+	}
+	if c.buffered() == 0 {
+		c.srv.setState(c, StateIdle) // waiting for data
+	}
+	return
+}
+
+// account n read bytes
+func (c *Context) doneRead(n int) {
+	if n > 0 {
+		atomic.AddInt64(&c.nread, int64(n))
+		c.srv.metrics().Read(n)
+		c.srv.setState(c, StateActive)
+		if c.it > 0 {
+			c.lastIO = time.Now()
+		}
+	}
+}
+
+// number of bytes can be read from read buffer
+func (c *Context) buffered() int {
+	switch {
+	case c.bin != nil && c.in == io.Reader(c.bin):
+		return c.bin.Buffered()
+	case c.lin != nil && c.in == io.Reader(c.lin):
+		return c.lin.Buffered()
+	}
+	return 0
+}
+
+// peek n buffered bytes
+func (c *Context) peek(n int) ([]byte, error) {
+	if c.lin != nil && c.in == io.Reader(c.lin) {
+		return c.lin.Peek(n)
+	}
+	return c.bin.Peek(n)
+}
+
+// write buffer or nil
+func (c *Context) writeBuffer() interface{ Flush() error } {
+	switch {
+	case c.bout != nil && c.out == io.Writer(c.bout):
+		return c.bout
+	case c.lout != nil && c.out == io.Writer(c.lout):
+		return c.lout
+	}
+	return nil
 }
 
 // Write wraps connection Write method. It refers to buffer
-// if connection is buffered
+// if connection is buffered. It refreshes write deadline if
+// (*Server).WriteTimeout or (*Server).IdleTimeout is set
 func (c *Context) Write(p []byte) (n int, err error) {
-	debugf("(*Context).Read: %v", c.RemoteAddr())
-	return c.out.Write(p)
+	if c.hijacked {
+		return 0, ErrHijacked
+	}
+	if err = c.writeDeadline(); err != nil {
+		return
+	}
+	if n, err = c.out.Write(p); n > 0 {
+		atomic.AddInt64(&c.nwritten, int64(n))
+		c.srv.metrics().Written(n)
+		if c.it > 0 {
+			c.lastIO = time.Now()
+		}
+	}
+	return
 }
 
 // Connection return undelrying net.Conn
@@ -102,11 +242,74 @@ func (c *Context) Connection() net.Conn {
 	return c.Conn
 }
 
+// Context returns context.Context of the connection. The context is
+// derived from (*Server).BaseContext and (*Server).ConnContext. It's
+// cancelled when the connection is closed after the last handler,
+// when a handler panics, when the server shuts down, that is when its
+// listener is closed by (*Grace).Close or Shutdown, or when the
+// connection is killed by the Shutdown. Use it to pass cancellation to
+// database calls, outbound RPCs, etc
+func (c *Context) Context() context.Context {
+	debugf("(*Context).Context: %v", c.RemoteAddr())
+	return c.cx
+}
+
+// Next invokes the rest of handlers of the chain inside the calling
+// handler. It's possible to run some code after all next handlers
+// (such as timing). The handlers already invoked by the Next are
+// not invoked again after the calling handler returns. Next does
+// nothing if the chain is aborted
+func (c *Context) Next() {
+	debugf("(*Context).Next: %v", c.RemoteAddr())
+	for c.index++; c.index < len(c.handlers); c.index++ {
+		if c.aborted {
+			return
+		}
+		atomic.StoreInt32(&c.handler, int32(c.index))
+		c.handlers[c.index](c)
+	}
+}
+
+// Abort prevents pending handlers from being called. It doesn't stop
+// the calling handler. Abort cancels the context.Context of the
+// connection. In the event loop mode the connection is closed after
+// the aborted chain, since its context.Context can't be used anymore
+func (c *Context) Abort() {
+	debugf("(*Context).Abort: %v", c.RemoteAddr())
+	c.aborted = true
+	c.cancel()
+}
+
+// AbortWithError aborts the chain with given reason. The error is
+// passed to (*Server).ErrorHandler after the chain
+func (c *Context) AbortWithError(err error) {
+	debugf("(*Context).AbortWithError: %v; %v", c.RemoteAddr(), err)
+	c.err = err
+	c.Abort()
+}
+
+// IsAborted returns true if the chain is aborted
+func (c *Context) IsAborted() bool {
+	debugf("(*Context).IsAborted: %v", c.RemoteAddr())
+	return c.aborted
+}
+
+// Err returns error the chain is aborted with or nil
+func (c *Context) Err() error {
+	debugf("(*Context).Err: %v", c.RemoteAddr())
+	return c.err
+}
+
 // Flush write buffer or do nothig
 func (c *Context) Flush() (err error) {
-	debugf("(*Context).Flush: %v", c.RemoteAddr())
-	if bout := c.bout; bout != nil {
-		err = bout.Flush()
+	if c.hijacked {
+		return ErrHijacked
+	}
+	if wb := c.writeBuffer(); wb != nil {
+		if err = c.writeDeadline(); err != nil {
+			return
+		}
+		err = wb.Flush()
 	}
 	return
 }
@@ -116,8 +319,15 @@ func (c *Context) Flush() (err error) {
 // called after last handler automatically
 func (c *Context) Close() (err error) {
 	debugf("(*Context).close: %v", c.RemoteAddr())
-	if bout := c.bout; bout != nil {
-		if err = bout.Flush(); err != nil {
+	if c.hijacked {
+		return ErrHijacked
+	}
+	c.closed = true
+	if wb := c.writeBuffer(); wb != nil {
+		if err = c.writeDeadline(); err == nil {
+			err = wb.Flush()
+		}
+		if err != nil {
 			c.Conn.Close() // drop second error
 			return
 		}
@@ -165,7 +375,26 @@ func (c *Context) reset() {
 	if c.bout != nil {
 		c.bout.Reset(nil)
 	}
+	if c.lin != nil {
+		c.lin.reset(nil, nil, 0) // return buffers
+	}
+	if c.lout != nil {
+		c.lout.reset(nil, nil, 0)
+	}
 	c.kv = nil
+	if cap(c.line) > DefaultMaxLineLength {
+		c.line = nil // don't keep long lines
+	}
+	c.rt, c.wt, c.it = 0, 0, 0
+	c.lastIO = time.Time{}
+	c.cx, c.cancel = nil, nil
+	c.handlers, c.index, c.aborted, c.err = nil, 0, false, nil
+	c.srv = nil
+	c.state, c.hijacked, c.closed, c.polled = 0, false, false, false
+	c.id, c.accepted, c.handler = 0, time.Time{}, 0
+	c.nread, c.nwritten = 0, 0
+	c.ipKey, c.netKey = "", ""
+	c.proxy = nil
 	c.Conn = nil
 }
 
@@ -175,18 +404,88 @@ func (c *Context) reset() {
 // between Handlers when connection is alive
 type Handler func(ctx *Context)
 
+// An ErrHandler is a connection handler that can fail. If it returns
+// an error, the chain is aborted with the error (see AbortWithError)
+type ErrHandler func(ctx *Context) error
+
+// Handler converts the ErrHandler to Handler
+func (e ErrHandler) Handler() Handler {
+	debugf("ErrHandler.Handler")
+	return func(ctx *Context) {
+		if err := e(ctx); err != nil {
+			ctx.AbortWithError(err)
+		}
+	}
+}
+
+// An ErrorHandler handles error of an aborted chain. The connection
+// is still alive and it's possible to write a reply
+type ErrorHandler func(ctx *Context, err error)
+
 // A Server implements TCL/TLS server
 type Server struct {
-	// Net is "tcp", "tcp4" or "tcp6", defaults to "tcp"
+	// Net is "tcp", "tcp4", "tcp6", "unix" or "unixpacket", defaults
+	// to "tcp". For unix sockets the Addr is path to socket file or, on
+	// Linux, name of abstract socket starting with "@"
 	Net string
 	// Addr is TCP address to listen on, "0.0.0.0:3000" if empty
 	Addr string
-	// Handlers are successive handlers to invoke
+	// Listeners are used by ListenAndServeAll instead of Net and Addr
+	// to serve many addresses by one server
+	Listeners []ListenerConfig
+	// Handlers are successive handlers to invoke. A handler can
+	// abort the chain using (*Context).Abort or AbortWithError
 	Handlers []Handler
+	// ErrorHandler is called after the chain if it's aborted with
+	// an error. If nil, the error is logged
+	ErrorHandler ErrorHandler
 	// WorkersLimit is a maximum number of simultaneous connections.
 	// Use No to avoid limitation. Use Default to set default limit.
-	// The limit must not be nagative (except No (-1))
+	// The limit must not be nagative (except No (-1)). It's not used
+	// in worker pool mode. If all workers are busy, an accepted
+	// connection waits for a worker without a deadline, while others
+	// wait in the listen backlog. The waiting connection is closed by
+	// the (*Grace).Close and Shutdown, but not if the listener is
+	// closed directly. Use worker pool mode with the PoolPolicy to
+	// reject or drop connections instead
 	WorkersLimit int
+	// PoolWorkers turns on worker pool mode, if it's positive. In the
+	// mode accepted connections are queued and served by the fixed
+	// number of workers instead of goroutine per connection. The
+	// workers are shared between listeners. Use ResizePool to change
+	// the number at runtime
+	PoolWorkers int
+	// PoolQueueSize is maximum number of accepted connections waiting
+	// for a worker. Use Default for the PoolWorkers or No for
+	// unbuffered queue
+	PoolQueueSize int
+	// PoolPolicy is what to do if the queue is full
+	PoolPolicy PoolPolicy
+	// BufferPool is optional pool of read and write buffers. If it's
+	// set, a Context borrows buffers from the pool on first Read or
+	// Write and returns them when they are empty or flushed, thus idle
+	// connections hold no buffers. Use DefaultBufferPool to share the
+	// buffers between servers
+	BufferPool *BufferPool
+	// EventLoop turns on epoll event loop mode (Linux only) for
+	// massive number of idle connections. In the mode an idle
+	// connection has no goroutine and no buffers, the buffers are
+	// borrowed from the BufferPool or from the DefaultBufferPool if
+	// it's nil. The Handlers are called every time a connection becomes
+	// readable and, then, while the read buffer has data. They should
+	// consume available data and return. A connection has one Context
+	// for its whole life, idle connections are listed by the Conns and
+	// closed by the (*Grace).Shutdown. The connection is closed if a
+	// handler calls (*Context).Close, if the chain is aborted, if the
+	// handlers return without reading available data or if the peer
+	// closed it. The (*Context).Connection can be kept to push data to
+	// an idle connection. Connections that can't be polled, TLS for
+	// example, are served by goroutines as usual. The PoolWorkers and
+	// the ProxyProtocol are not supported in the mode
+	EventLoop bool
+	// EventLoops is number of epoll instances. Use Default for number
+	// of CPUs
+	EventLoops int
 	// ReadBufferSize. By default a connection is buffered with
 	// default buffer size. Use No to avoid buffering. Provide any
 	// positive integer value to set particular size. All connections
@@ -199,17 +498,153 @@ type Server struct {
 	// will have the same buffer size. Feel free to use Default for
 	// readability of your code.
 	WriteBufferSize int
+	// Frame describes length-prefixed frames of the (*Context).ReadFrame
+	// and WriteFrame
+	Frame FrameOptions
+	// Line describes lines of the (*Context).ReadLine and WriteLine
+	Line LineOptions
+	// ReadTimeout is maximum duration for a (*Context).Read call. The
+	// deadline is refreshed by every Read. Zero means no timeout
+	ReadTimeout time.Duration
+	// WriteTimeout is maximum duration for a (*Context).Write or
+	// (*Context).Flush call. The deadline is refreshed by every Write
+	// or Flush. Zero means no timeout
+	WriteTimeout time.Duration
+	// IdleTimeout is maximum duration a connection can spend without
+	// reading or writing. It's checked by (*Context).Read, Write and
+	// Flush. Zero means no timeout. Use errors.Is(err,
+	// os.ErrDeadlineExceeded) to distinguish a timeout of any of the
+	// three from a client disconnect
+	IdleTimeout time.Duration
+	// BaseContext optionally specifies a function that returns the
+	// base context for connections accepted by the Serve. The provided
+	// Listener is the specific Listener that's about to start accepting
+	// connections. If BaseContext is nil, the default is
+	// context.Background(). If non-nil, it must return a non-nil
+	// context
+	BaseContext func(net.Listener) context.Context
+	// ConnContext optionally specifies a function that modifies the
+	// context used for a new connection c. The provided ctx is derived
+	// from the base context. If non-nil, it must return a non-nil
+	// context
+	ConnContext func(ctx context.Context, c net.Conn) context.Context
+	// AllowCIDRs is initial list of allowed networks, like "10.0.0.0/8".
+	// If it's not empty, connections from other addresses are closed
+	// right after accept. Use SetIPFilter to change the lists at
+	// runtime
+	AllowCIDRs []string
+	// DenyCIDRs is initial list of denied networks. Connections from
+	// these networks are closed right after accept. Denied connections
+	// are logged with debug level and counted by the Metrics
+	DenyCIDRs []string
+	// AcceptFilter is optional hook, a connection is closed right
+	// after accept if the AcceptFilter returns false for its remote
+	// address. The filters are checked before a worker slot is used
+	AcceptFilter func(net.Addr) bool
+	// MaxConnsPerIP is maximum number of simultaneous connections from
+	// one IP address. Zero means no limit. Rejected connections are
+	// logged, see RejectBanner
+	MaxConnsPerIP int
+	// MaxConnsPerCIDR is maximum number of simultaneous connections from
+	// one network. The network is defined by CIDRPrefixV4 and
+	// CIDRPrefixV6. Zero means no limit
+	MaxConnsPerCIDR int
+	// CIDRPrefixV4 is prefix length of IPv4 network, 24 if zero
+	CIDRPrefixV4 int
+	// CIDRPrefixV6 is prefix length of IPv6 network, 64 if zero
+	CIDRPrefixV6 int
+	// ConnRatePerIP is rate of new connections per second from one IP
+	// address (token bucket). Zero means no limit
+	ConnRatePerIP float64
+	// ConnBurstPerIP is maximum burst of new connections from one IP
+	// address. If zero, the ConnRatePerIP (but at least 1) is used
+	ConnBurstPerIP int
+	// RejectBanner is optional message written to a connection rejected
+	// by per-IP limits or by full worker pool queue before it's closed.
+	// Only a few banners are written at once, connections rejected
+	// during a flood are closed without it. Rejections are logged as
+	// warnings, one record per second at most, the record has number
+	// of skipped ones
+	RejectBanner []byte
+	// Metrics is optional metrics collector. See PromMetrics for
+	// default implementation
+	Metrics Metrics
+	// ProxyProtocol turns on PROXY protocol v1 and v2 support. A
+	// connection from trusted source must start with the PROXY header,
+	// the header is read before the handlers chain. Then RemoteAddr
+	// and LocalAddr of the Context return real addresses. For TLS
+	// connection the header is read before TLS handshake. Note, that
+	// accept filters and per-IP limits use address of the proxy
+	ProxyProtocol bool
+	// ProxyTrustedCIDRs is list of networks PROXY headers are accepted
+	// from. Connections from other addresses are served as is. It's
+	// required by the ProxyProtocol, use "0.0.0.0/0" and "::/0" to
+	// trust all sources explicitly
+	ProxyTrustedCIDRs []string
+	// ProxyHeaderTimeout is maximum duration for reading PROXY header,
+	// 5s if zero
+	ProxyHeaderTimeout time.Duration
+	// ConnState specifies an optional callback function that is
+	// called when a client connection changes state. See the
+	// ConnState type and associated constants for details. The
+	// callback is called from many goroutines at once
+	ConnState func(net.Conn, ConnState)
+	// UnixSocket is optional mode and ownership of unix socket files
+	UnixSocket UnixSocket
+	// Acceptors is number of listeners per TCP address, each with its
+	// own accepting goroutine. The listeners use SO_REUSEPORT and share
+	// the WorkersLimit and the graceful shutdown. Use Default or 1 for
+	// one listener. It's used by ListenAndServe* methods and by the
+	// Grace, the Serve serves one given listener
+	Acceptors int
+	// Socket is options of listening TCP sockets
+	Socket SocketOptions
+	// TCP is options of accepted TCP connections, they are applied
+	// before a Context created. TLS connections are unwrapped to set
+	// them. If the options have no effect, for example for a custom
+	// connection that can't be unwrapped, a warning is logged once
+	TCP TCPOptions
 	// TLSConfig is optional TLS config, used by ListenAndServeTLS
 	TLSConfig *tls.Config
+	// Logger specifies an optional structured logger for errors
+	// accepting connections and unexpected behavior from handlers.
+	// Records of a connection have "conn_id", "remote_addr" and
+	// "handler" attributes, and optional "error" and "stack". If nil,
+	// the ErrorLog is used
+	Logger *slog.Logger
 	// ErrorLog specifies an optional logger for errors accepting
-	// connections and unexpected behavior from handlers.
-	// If nil, logging goes to os.Stderr via the log package's
-	// standard logger.
+	// connections and unexpected behavior from handlers. It's used
+	// if the Logger is nil. Attributes are printed as key=value,
+	// debug records are not printed. If nil, logging goes to os.Stderr
+	// via the log package's standard logger.
 	ErrorLog *log.Logger
 
+	// middlewares added by Use
+	middlewares []Middleware
+
 	// avoid alloc/GC pressure if many short-lived buffered connections
 	// are coming
 	ctxPool sync.Pool // one pool per server (because of buffers sizes)
+
+	// in-flight connections
+	mu     sync.Mutex
+	active map[uint64]*Context
+	lastID uint64
+	idle   idleSignal    // no in-flight connections
+	limit  int           // effective workers limit
+	sem    chan struct{} // workers, shared between listeners
+
+	served map[net.Listener]net.Listener // wrapped listeners of the Serve
+
+	pool    *workerPool // worker pool mode
+	tcpWarn sync.Once   // log TCP options failure once
+
+	ipLim     ipLimiter    // per-IP limits state
+	rejecting int32        // banners being written, atomic
+	rejectLog rejectLog    // rate of rejection records
+	ipFilter  atomic.Value // *IPFilter
+
+	proxyTrusted []*net.IPNet // trusted sources of PROXY headers
 }
 
 // used if not nil (for tests)
@@ -231,16 +666,49 @@ func (s *Server) putContext(ctx *Context) {
 	s.ctxPool.Put(ctx)
 }
 
-// create context by connection and buffers sizes
-func (s *Server) createContext(conn net.Conn, rbs, wbs int) (ctx *Context) {
+// pool of lazy buffers or nil, the event loop mode uses the
+// DefaultBufferPool if the BufferPool is not set, since idle
+// connections keep their Contexts
+func (s *Server) buffers() *BufferPool {
+	if s.BufferPool == nil && s.EventLoop {
+		return DefaultBufferPool
+	}
+	return s.BufferPool
+}
+
+// create context by base context, connection and buffers sizes
+func (s *Server) createContext(base context.Context, conn net.Conn, rbs,
+	wbs int) (ctx *Context) {
+
 	debugf("(*Server).createContext")
 	ctx = s.getContext()
 	ctx.Conn = conn
+	ctx.srv = s
+	ctx.accepted, ctx.handler = time.Now(), -1
+	// set up context.Context
+	if s.ConnContext != nil {
+		if base = s.ConnContext(base, conn); base == nil {
+			panic("ConnContext returned nil")
+		}
+	}
+	ctx.cx, ctx.cancel = context.WithCancel(base)
+	// set up timeouts
+	ctx.rt, ctx.wt, ctx.it = s.ReadTimeout, s.WriteTimeout, s.IdleTimeout
+	if ctx.it > 0 {
+		ctx.lastIO = time.Now()
+	}
 	// set up reader
-	switch rbs {
-	case No: // -1
+	var pool = s.buffers()
+	switch {
+	case rbs == No: // -1
 		ctx.in = conn
-	case Default: // 0
+	case pool != nil: // lazy
+		if ctx.lin == nil {
+			ctx.lin = new(lazyReader)
+		}
+		ctx.lin.reset(conn, pool, bufferSize(rbs))
+		ctx.in = ctx.lin
+	case rbs == Default: // 0
 		// create new bufio.Reader
 		if ctx.bin == nil {
 			ctx.bin = bufio.NewReader(conn)
@@ -258,10 +726,16 @@ func (s *Server) createContext(conn net.Conn, rbs, wbs int) (ctx *Context) {
 		ctx.in = ctx.bin
 	}
 	// set up writer
-	switch wbs {
-	case No: // -1
+	switch {
+	case wbs == No: // -1
 		ctx.out = conn
-	case Default: // 0
+	case pool != nil: // lazy
+		if ctx.lout == nil {
+			ctx.lout = new(lazyWriter)
+		}
+		ctx.lout.reset(conn, pool, bufferSize(wbs))
+		ctx.out = ctx.lout
+	case wbs == Default: // 0
 		// create new bufio.Writer
 		if ctx.bout == nil {
 			ctx.bout = bufio.NewWriter(conn)
@@ -283,6 +757,96 @@ func (s *Server) createContext(conn net.Conn, rbs, wbs int) (ctx *Context) {
 	return
 }
 
+// add or remove in-flight connection, an added connection
+// gets its unique ID
+func (s *Server) trackContext(ctx *Context, add bool) {
+	debugf("(*Server).trackContext: %v", add)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.active == nil {
+			s.active = make(map[uint64]*Context)
+		}
+		s.lastID++
+		ctx.id = s.lastID
+		s.active[ctx.id] = ctx
+	} else {
+		delete(s.active, ctx.id)
+		if len(s.active) == 0 {
+			s.idle.notify()
+		}
+	}
+	s.metrics().Active(len(s.active), s.limit)
+}
+
+// closed when there are no in-flight connections
+func (s *Server) drained() <-chan struct{} {
+	debugf("(*Server).drained")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.idle.wait(len(s.active))
+}
+
+// number of in-flight connections
+func (s *Server) activeCount() (n int) {
+	debugf("(*Server).activeCount")
+	s.mu.Lock()
+	n = len(s.active)
+	s.mu.Unlock()
+	return
+}
+
+// cancel the context.Context and close the connection, a handler gets
+// an error on next I/O call; a connection of an event loop is shut down
+// and closed by its loop
+func (c *Context) kill() error {
+	c.cancel()
+	if c.polled {
+		return shutdownConn(c.Conn)
+	}
+	return c.Conn.Close()
+}
+
+// close all in-flight connections, returns number of closed
+func (s *Server) closeActive() (n int) {
+	debugf("(*Server).closeActive")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ctx := range s.active {
+		ctx.kill() // handler gets an error and returns
+		n++
+	}
+	return
+}
+
+// add or remove listener of the Serve and its wrapped version
+func (s *Server) trackListener(l, wrapped net.Listener, add bool) {
+	debugf("(*Server).trackListener: %v", add)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.served, l)
+		return
+	}
+	if s.served == nil {
+		s.served = make(map[net.Listener]net.Listener)
+	}
+	s.served[l] = wrapped
+}
+
+// close listener of the Serve by its wrapped version, that closes the
+// listener and stops accepted connections waiting for workers
+func (s *Server) closeListener(l net.Listener) error {
+	debugf("(*Server).closeListener")
+	s.mu.Lock()
+	wrapped, ok := s.served[l]
+	s.mu.Unlock()
+	if ok {
+		return wrapped.Close()
+	}
+	return l.Close()
+}
+
 // wrap listener with LimitListener if need
 func (s *Server) limitWorkes(l net.Listener) (ll net.Listener, err error) {
 	debugf("(*Server).limitWorkers")
@@ -291,23 +855,34 @@ func (s *Server) limitWorkes(l net.Listener) (ll net.Listener, err error) {
 		wl = defaultWorkersLimit
 		fallthrough
 	case wl > 0: // > 0
-		ll = netutil.LimitListener(l, wl) //s.WorkersLimit)
+		ll = newLimitListener(l, s.workers(wl))
+		s.setLimit(wl)
 	case wl == No: // == -1
 		ll = l // do nothing
+		s.setLimit(No)
 	default: // < -1
 		err = fmt.Errorf("negative (*Server).WorkersLimit: %d", s.WorkersLimit)
 	}
 	return
 }
 
-// log errors
-func (s *Server) logf(format string, args ...interface{}) {
-	debugf("(*Server).logf")
-	if s.ErrorLog != nil {
-		s.ErrorLog.Printf(format, args...)
-	} else {
-		log.Printf(format, args...)
+// semaphore of workers shared between all listeners
+func (s *Server) workers(limit int) chan struct{} {
+	debugf("(*Server).workers: %d", limit)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sem == nil || cap(s.sem) != limit {
+		s.sem = make(chan struct{}, limit)
 	}
+	return s.sem
+}
+
+// store effective workers limit
+func (s *Server) setLimit(limit int) {
+	debugf("(*Server).setLimit: %d", limit)
+	s.mu.Lock()
+	s.limit = limit
+	s.mu.Unlock()
 }
 
 // test buffer sizes
@@ -339,11 +914,10 @@ func (s *Server) an() (a, n string) {
 	return
 }
 
-func (s *Server) listen() (l net.Listener, err error) {
+func (s *Server) listen() (ls []net.Listener, err error) {
 	debugf("(*Server).listen")
 	a, n := s.an()
-	l, err = net.Listen(n, a)
-	return
+	return s.listenAcceptors(n, a)
 }
 
 // ListenAndServe listens on the TCP network (*Server).Net and address
@@ -352,11 +926,11 @@ func (s *Server) listen() (l net.Listener, err error) {
 // "0.0.0.0:3000" is used. ListenAndServe always returns a non-nil error
 func (s *Server) ListenAndServe() error {
 	debugf("(*Server).ListenAndServe")
-	l, err := s.listen()
+	ls, err := s.listen()
 	if err != nil {
 		return err
 	}
-	return s.Serve(l)
+	return s.ServeAll(ls...)
 }
 
 func cloneTLSConfig(cfg *tls.Config) *tls.Config {
@@ -389,10 +963,17 @@ func cloneTLSConfig(cfg *tls.Config) *tls.Config {
 	}
 }
 
-func (s *Server) listenTLS(certFile, keyFile string) (l net.Listener,
+func (s *Server) listenTLS(certFile, keyFile string) (ls []net.Listener,
 	err error) {
 	debugf("(*Server).listenTLS")
 	a, n := s.an()
+	return s.listenTLSOn(n, a, certFile, keyFile)
+}
+
+func (s *Server) listenTLSOn(n, a, certFile, keyFile string) (
+	ls []net.Listener, err error) {
+
+	debugf("(*Server).listenTLSOn")
 	config := cloneTLSConfig(s.TLSConfig)
 	configHasCert := len(config.Certificates) > 0 ||
 		config.GetCertificate != nil
@@ -403,7 +984,12 @@ func (s *Server) listenTLS(certFile, keyFile string) (l net.Listener,
 			return
 		}
 	}
-	l, err = tls.Listen(n, a, config)
+	if ls, err = s.listenAcceptors(n, a); err != nil {
+		return
+	}
+	for i, l := range ls {
+		ls[i] = tls.NewListener(l, config)
+	}
 	return
 }
 
@@ -421,11 +1007,11 @@ func (s *Server) listenTLS(certFile, keyFile string) (l net.Listener,
 // ListenAndServeTLS always returns a non-nil error.
 func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	debugf("(*Server).ListenAndServeTLS")
-	l, err := s.listenTLS(certFile, keyFile)
+	ls, err := s.listenTLS(certFile, keyFile)
 	if err != nil {
 		return err
 	}
-	return s.Serve(l)
+	return s.ServeAll(ls...)
 }
 
 // Serve accepts incoming connections on the Listener l, creating a new service
@@ -437,6 +1023,7 @@ func (s *Server) Serve(l net.Listener) (err error) {
 	debugf("(*Server).Serve")
 	// close the Listener after all
 	defer l.Close()
+	var served = l // the l before wrapping
 	// invoke hook for tests
 	if testHookServerServe != nil {
 		testHookServerServe(s, l)
@@ -446,10 +1033,77 @@ func (s *Server) Serve(l net.Listener) (err error) {
 	if rbs, wbs, err = s.bufferSizes(); err != nil {
 		return
 	}
-	// set workers limit
-	if l, err = s.limitWorkes(l); err != nil {
+	// test per-IP limits
+	if err = s.checkIPLimits(); err != nil {
+		return
+	}
+	// IP filters
+	if err = s.initIPFilter(); err != nil {
+		return
+	}
+	// PROXY protocol
+	if err = s.initProxy(); err != nil {
+		return
+	}
+	// TCP options
+	if err = s.TCP.check(); err != nil {
+		return
+	}
+	var tune = s.TCP.isSet()
+	// frames
+	if err = s.Frame.check(); err != nil {
+		return
+	}
+	// lines
+	if err = s.Line.check(); err != nil {
+		return
+	}
+	// compose middlewares
+	var chain = s.chain()
+	// base context of all connections
+	var base = context.Background()
+	if s.BaseContext != nil {
+		if base = s.BaseContext(l); base == nil {
+			panic("BaseContext returned nil")
+		}
+	}
+	// filter connections before the limit
+	l = &filterListener{Listener: l, s: s}
+	// worker pool or workers limit
+	var workers, queue int
+	if workers, queue, err = s.poolOptions(); err != nil {
+		return
+	}
+	var pool *workerPool
+	if s.EventLoop {
+		if err = s.checkEventLoop(); err != nil {
+			return
+		}
+	}
+	if workers > 0 {
+		pool = s.startPool(workers, queue)
+		defer s.stopPool(pool)
+	} else if l, err = s.limitWorkes(l); err != nil {
 		return
 	}
+	// the wrapped listener is closed by the closeListener, that stops
+	// accepted connections waiting for workers
+	s.trackListener(served, l, true)
+	defer s.trackListener(served, l, false)
+	defer l.Close()
+	// contexts of connections are cancelled when the Serve returns,
+	// that is when the server starts shutting down
+	var cancelBase context.CancelFunc
+	base, cancelBase = context.WithCancel(base)
+	defer cancelBase()
+	// event loop mode
+	var loops *eventLoops
+	if s.EventLoop {
+		if loops, err = s.startEventLoops(base, chain, rbs, wbs); err != nil {
+			return
+		}
+		defer loops.stop()
+	}
 	// how long to sleep on accept failure
 	var tempDelay time.Duration
 	// accept loop
@@ -469,8 +1123,9 @@ func (s *Server) Serve(l net.Listener) (err error) {
 				if tempDelay > maxTempDelay {
 					tempDelay = maxTempDelay
 				}
-				s.logf("(*Server).Serve Accept error: %v; retrying in %v", e,
-					tempDelay)
+				s.log(slog.LevelWarn, "accept error", "error", e,
+					"backoff", tempDelay)
+				s.metrics().TempError(tempDelay)
 				time.Sleep(tempDelay) // await
 				continue              // try again
 			}
@@ -478,34 +1133,107 @@ func (s *Server) Serve(l net.Listener) (err error) {
 		}
 		tempDelay = 0
 		debugf("(*Server).Serve accept connection")
-		go s.serve(conn, rbs, wbs)
+		s.metrics().Accepted()
+		// per-IP limits
+		ipKey, netKey, reason := s.admit(conn.RemoteAddr())
+		if reason != "" {
+			s.reject(conn, reason)
+			continue
+		}
+		// TCP options
+		if tune {
+			s.tuneConn(conn)
+		}
+		// idle connections are polled
+		if loops != nil && loops.add(conn, ipKey, netKey) {
+			continue
+		}
+		// create context and track it before the service
+		// goroutine starts, to make it visible for Shutdown
+		ctx := s.createContext(base, conn, rbs, wbs)
+		ctx.ipKey, ctx.netKey = ipKey, netKey
+		s.trackContext(ctx, true)
+		s.setState(ctx, StateNew)
+		if pool != nil {
+			s.enqueue(pool, ctx, chain)
+			continue
+		}
+		go s.serve(ctx, chain)
 	}
 	//return
 }
 
-func (s *Server) serve(conn net.Conn, rbs, wbs int) {
+// stack trace of current goroutine
+func stack() []byte {
+	debugf("stack")
+	const size = 64 << 10
+	buf := make([]byte, size)
+	return buf[:runtime.Stack(buf, false)]
+}
+
+func (s *Server) serve(ctx *Context, chain Handler) {
 	debugf("(*Server).serve")
-	// create context
-	ctx := s.createContext(conn, rbs, wbs)
 	// finialize
 	defer func() {
 		// handle Handers' panics
 		if err := recover(); err != nil {
-			const size = 64 << 10
-			buf := make([]byte, size)
-			buf = buf[:runtime.Stack(buf, false)]
-			s.logf("panic serving %v: %v\n%s", ctx.RemoteAddr(), err, buf)
+			s.log(slog.LevelError, "panic serving",
+				ctx.logAttrs("error", err, "stack", stack())...)
+			s.metrics().Panic()
+			s.metrics().Failed()
 		}
-		// close connection
-		if err := ctx.Close(); err != nil {
-			s.logf("error closing connection: %v", err)
+		// close connection, if it's not hijacked; a killed one is
+		// closed already
+		if !ctx.hijacked {
+			err := ctx.Close()
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				s.log(slog.LevelError, "error closing connection",
+					ctx.logAttrs("error", err)...)
+			}
+		}
+		// release context.Context
+		ctx.cancel()
+		// the connection is not in-flight anymore
+		s.trackContext(ctx, false)
+		s.release(ctx.ipKey, ctx.netKey)
+		if !ctx.hijacked {
+			s.metrics().Closed(time.Since(ctx.accepted))
+			s.setState(ctx, StateClosed)
 		}
 		// reset context and put it into the pool
 		s.putContext(ctx)
 	}()
-	// invoke handlers one by one
-	for _, h := range s.Handlers {
-		h(ctx)
+	s.setState(ctx, StateActive)
+	// real addresses
+	if err := s.readProxy(ctx); err != nil {
+		s.rejectProxy(ctx, err)
+		return
+	}
+	// invoke middlewares and handlers one by one
+	ctx.handlers, ctx.index = s.Handlers, -1
+	chain(ctx)
+	s.handleAbort(ctx)
+}
+
+// handle abort reason of the chain, if any
+func (s *Server) handleAbort(ctx *Context) {
+	debugf("(*Server).handleAbort")
+	err := ctx.err
+	if err == nil {
+		return
+	}
+	if _, ok := err.(*PanicError); ok {
+		s.metrics().Panic()
+	}
+	s.metrics().Failed()
+	if s.ErrorHandler != nil {
+		s.ErrorHandler(ctx, err)
+	} else if pe, ok := err.(*PanicError); ok {
+		s.log(slog.LevelError, "panic serving",
+			ctx.logAttrs("error", pe.Value, "stack", pe.Stack)...)
+	} else {
+		s.log(slog.LevelError, "error serving",
+			ctx.logAttrs("error", err)...)
 	}
 }
 
@@ -524,14 +1252,30 @@ type Grace struct {
 	done   chan struct{}
 	once   *sync.Once
 	err    error
-	l      net.Listener
+	ls     []net.Listener
+	pc     net.PacketConn
+	ps     *PacketServer // serves the pc
+	s      *Server
+	d      drainer // the s or a packet server
+
+	mu              sync.Mutex
+	drained, killed int // shutdown statistic
 }
 
 func (g *Grace) prepare() {
 	debugf("(*Grace).prepare")
 	g.closed = make(chan struct{})
+	g.done = make(chan struct{})
 	g.once = new(sync.Once)
 	g.err = nil
+	g.setStat(0, 0)
+}
+
+// set shutdown statistic
+func (g *Grace) setStat(drained, killed int) {
+	g.mu.Lock()
+	g.drained, g.killed = drained, killed
+	g.mu.Unlock()
 }
 
 // Done is closed when server is closed
@@ -540,45 +1284,83 @@ func (g *Grace) Done() <-chan struct{} {
 	return g.done
 }
 
+// failed to start
+func (g *Grace) fail(err error) {
+	debugf("(*Grace).fail: %v", err)
+	g.prepare()
+	g.err = err
+	close(g.done)
+}
+
 // ListenAndServe in separate gorotine. It panics if 's' is nil
 func (g *Grace) ListenAndServe(s *Server) {
 	debugf("(*Grace).ListenAndServe")
-	g.done = make(chan struct{})
-	l, err := s.listen()
+	ls, err := s.listen()
 	if err != nil {
-		g.err = err
-		close(g.done)
+		g.fail(err)
 		return
 	}
-	g.Serve(s, l)
+	g.ServeAll(s, ls...)
 }
 
 // ListenAndServeTLS in separate gorotine. It panics if 's' is nil
 func (g *Grace) ListenAndServeTLS(s *Server, certFile, keyFile string) {
 	debugf("(*Grace).ListenAndServeTLS")
-	g.done = make(chan struct{})
-	l, err := s.listenTLS(certFile, keyFile)
+	ls, err := s.listenTLS(certFile, keyFile)
 	if err != nil {
-		g.err = err
-		close(g.done)
+		g.fail(err)
 		return
 	}
-	g.Serve(s, l)
+	g.ServeAll(s, ls...)
+}
+
+// ListenAndServeAll listens on all (*Server).Listeners and serves
+// them in separate gorotines. It panics if 's' is nil
+func (g *Grace) ListenAndServeAll(s *Server) {
+	debugf("(*Grace).ListenAndServeAll")
+	ls, err := s.listenAll()
+	if err != nil {
+		g.fail(err)
+		return
+	}
+	g.ServeAll(s, ls...)
 }
 
 // Serve in separate gorotine. It panics if 's' is nil
 func (g *Grace) Serve(s *Server, l net.Listener) {
 	debugf("(*Grace).Serve")
+	g.ServeAll(s, l)
+}
+
+// ServeAll serves given listeners, each in separate gorotine. If
+// one of the listeners fails, all other are closed. The Done is
+// closed when all listeners are closed. It panics if 's' is nil
+func (g *Grace) ServeAll(s *Server, ls ...net.Listener) {
+	debugf("(*Grace).ServeAll")
 	g.prepare()
+	g.s = s
+	g.ls = ls
+	g.pc, g.ps, g.d = nil, nil, s
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+	)
+	for _, l := range ls {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			err := s.Serve(l)
+			debugf("(*Grace).ServeAll: (*Server).Serve returns")
+			select {
+			case <-g.closed:
+			default:
+				errOnce.Do(func() { g.err = err })
+				g.Close() // close others
+			}
+		}(l)
+	}
 	go func() {
-		g.l = l
-		err := s.Serve(l)
-		debugf("(*Grace).Serve: (*Server).Serve returns")
-		select {
-		case <-g.closed:
-		default:
-			g.err = err
-		}
+		wg.Wait()
 		close(g.done)
 	}()
 }
@@ -586,15 +1368,106 @@ func (g *Grace) Serve(s *Server, l net.Listener) {
 // Close stops server
 func (g *Grace) Close() {
 	debugf("(*Grace).Close")
-	if g.once != nil && g.l != nil {
+	if g.once != nil && (len(g.ls) > 0 || g.pc != nil) {
 		g.once.Do(func() {
 			debugf("(*Grace).Close once.Do func")
 			close(g.closed)
-			g.l.Close()
+			for _, l := range g.ls {
+				g.s.closeListener(l)
+			}
+			if g.pc != nil {
+				g.ps.stop(g.pc) // the Serve closes it
+			}
 		})
 	}
 }
 
+// a drainer is a server with in-flight connections or packets
+type drainer interface {
+	activeCount() int
+	closeActive() int
+	drained() <-chan struct{}
+}
+
+// an idleSignal is a channel closed when there is nothing in-flight,
+// it's guarded by mutex of its owner
+type idleSignal struct {
+	ch chan struct{}
+}
+
+// channel closed when there is nothing in-flight
+func (i *idleSignal) wait(active int) <-chan struct{} {
+	if active == 0 {
+		return closedChan
+	}
+	if i.ch == nil {
+		i.ch = make(chan struct{})
+	}
+	return i.ch
+}
+
+// notify waiters, there is nothing in-flight
+func (i *idleSignal) notify() {
+	if i.ch != nil {
+		close(i.ch)
+		i.ch = nil
+	}
+}
+
+// always closed channel
+var closedChan = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
+// Shutdown stops accepting new connections and waits for all in-flight
+// handler chains to return. If the ctx expires first, remaining
+// connections are force-closed and the ctx error is returned. Use
+// ShutdownStat to get number of drained and killed connections. The
+// Done channel is closed when the accept loop is stopped, that
+// happens before the Shutdown returns
+func (g *Grace) Shutdown(ctx context.Context) (err error) {
+	debugf("(*Grace).Shutdown")
+	if g.done == nil || g.d == nil {
+		return // not started
+	}
+	var start = g.d.activeCount()
+	g.Close()
+	// wait for the accept loop
+	select {
+	case <-g.done:
+	case <-ctx.Done():
+	}
+	if n := g.d.activeCount(); n > start {
+		start = n // accepted before the Close
+	}
+	select {
+	case <-g.d.drained():
+		g.setStat(start, 0)
+		return
+	case <-ctx.Done():
+	}
+	var killed = g.d.closeActive()
+	if start -= killed; start < 0 {
+		start = 0 // accepted while the ctx was expiring
+	}
+	g.setStat(start, killed)
+	if g.s != nil {
+		<-g.done // the accept loop doesn't wait for workers after the Close
+	}
+	return ctx.Err()
+}
+
+// ShutdownStat returns number of connections drained and killed by
+// last Shutdown
+func (g *Grace) ShutdownStat() (drained, killed int) {
+	debugf("(*Grace).ShutdownStat")
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.drained, g.killed
+}
+
 // Err returns server error when it's closed
 func (g *Grace) Err() error {
 	debugf("(*Grace).Err")
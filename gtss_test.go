@@ -28,9 +28,19 @@ package gtss
 import (
 	"testing"
 
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"log/slog"
 	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -108,6 +118,16 @@ func recv(addr string, rn int) (reply []byte, err error) {
 	return
 }
 
+// read until EOF
+func recvAll(addr string) (reply []byte, err error) {
+	var c net.Conn
+	if c, err = net.Dial("tcp", addr); err != nil {
+		return
+	}
+	defer c.Close()
+	return ioutil.ReadAll(c)
+}
+
 func open(addr string) (c net.Conn, err error) {
 	c, err = net.Dial("tcp", addr)
 	return
@@ -573,6 +593,408 @@ Try:
 	}
 }
 
+// start given server using Grace, the newServer is called on every try
+func graceServe(t *testing.T, newServer func() *Server) (g *Grace,
+	ln net.Listener) {
+
+	serveNotify := beforeServe()
+	defer afterServe()
+
+	for try := 0; try < maxTries; try++ {
+		g = new(Grace)
+		g.ListenAndServe(newServer())
+		select {
+		case <-g.Done():
+			t.Logf("On try #%v: %v", try+1, g.Err())
+			continue
+		case ln = <-serveNotify:
+			t.Logf("listening on: %v", ln.Addr())
+			return
+		}
+	}
+	t.Fatalf("Failed to start up after %d tries", maxTries)
+	return
+}
+
+func TestGrace_ShutdownDrain(t *testing.T) {
+	data := []byte("Hello")
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    No,
+			ReadBufferSize:  No,
+			WriteBufferSize: No,
+			Handlers: []Handler{
+				func(ctx *Context) {
+					time.Sleep(50 * time.Millisecond)
+				},
+				hSend(data, t),
+			},
+		}
+	})
+	conn, err := open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for g.s.activeCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// the stat can be read from other goroutine
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				g.ShutdownStat()
+			}
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := g.Shutdown(ctx); err != nil {
+		t.Fatal("shutdown error:", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("drain is not signalled:", d)
+	}
+	if drained, killed := g.ShutdownStat(); drained != 1 || killed != 0 {
+		t.Errorf("wrong stat: drained %d, killed %d", drained, killed)
+	}
+	reply := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal("client receiving error:", err)
+	}
+	if string(reply) != string(data) {
+		t.Errorf("wrong msg from server: expected %q, got %q", string(data),
+			string(reply))
+	}
+}
+
+func TestGrace_ShutdownKill(t *testing.T) {
+	var logs syncBuffer
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    No,
+			ReadBufferSize:  No,
+			WriteBufferSize: No,
+			Logger:          slog.New(slog.NewTextHandler(&logs, nil)),
+			Handlers: []Handler{
+				func(ctx *Context) {
+					io.Copy(ctx, ctx) // until closed
+				},
+			},
+		}
+	})
+	conn, err := open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for g.s.activeCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	if err := g.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("unexpected shutdown error: %v", err)
+	}
+	if drained, killed := g.ShutdownStat(); drained != 0 || killed != 1 {
+		t.Errorf("wrong stat: drained %d, killed %d", drained, killed)
+	}
+	if g.Err() != nil {
+		t.Errorf("server closing error: %v", g.Err())
+	}
+	// the handler returns after the Shutdown
+	time.Sleep(50 * time.Millisecond)
+	if strings.Contains(logs.String(), "error closing connection") {
+		t.Errorf("killed connection closing is logged: %q", logs.String())
+	}
+}
+
+func TestGrace_ShutdownWaitingWorker(t *testing.T) {
+	var served int32
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    1,
+			ReadBufferSize:  No,
+			WriteBufferSize: No,
+			ErrorLog:        discardLogger(),
+			Handlers: []Handler{
+				func(ctx *Context) {
+					atomic.AddInt32(&served, 1)
+					ctx.Write([]byte("ok"))
+					io.Copy(io.Discard, ctx) // until closed
+				},
+			},
+		}
+	})
+	busy, err := open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	if _, err = io.ReadFull(busy, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	// accepted, but waits for the worker
+	pending, err := open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pending.Close()
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(),
+		200*time.Millisecond)
+	defer cancel()
+	if err = g.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("unexpected shutdown error: %v", err)
+	}
+	select {
+	case <-g.Done():
+	default:
+		t.Error("Done is not closed")
+	}
+	pending.SetDeadline(time.Now().Add(time.Second))
+	if n, err := pending.Read(make([]byte, 2)); n != 0 || err == nil ||
+		errors.Is(err, os.ErrDeadlineExceeded) {
+
+		t.Errorf("pending connection is served: %d, %v", n, err)
+	}
+	if n := atomic.LoadInt32(&served); n != 1 {
+		t.Errorf("served %d connections", n)
+	}
+}
+
+func TestServer_ReadTimeout(t *testing.T) {
+	done := make(chan struct{})
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    No,
+			ReadBufferSize:  Default,
+			WriteBufferSize: No,
+			ReadTimeout:     50 * time.Millisecond,
+			Handlers: []Handler{
+				func(ctx *Context) {
+					defer close(done)
+					_, err := ctx.Read(make([]byte, 1))
+					if !errors.Is(err, os.ErrDeadlineExceeded) {
+						t.Errorf("expected timeout error, got %v", err)
+					}
+				},
+			},
+		}
+	})
+	defer g.Close()
+	conn, err := open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout is not reached")
+	}
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	data := []byte("Hello")
+	done := make(chan struct{})
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    No,
+			ReadBufferSize:  No,
+			WriteBufferSize: No,
+			ReadTimeout:     5 * time.Second,
+			IdleTimeout:     50 * time.Millisecond,
+			Handlers: []Handler{
+				hRecv(data, t),
+				func(ctx *Context) {
+					defer close(done)
+					_, err := ctx.Read(make([]byte, 1))
+					if !errors.Is(err, os.ErrDeadlineExceeded) {
+						t.Errorf("expected timeout error, got %v", err)
+					}
+				},
+			},
+		}
+	})
+	defer g.Close()
+	conn, err := open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle timeout is not reached")
+	}
+}
+
+type ctxKey string
+
+func TestContext_Context(t *testing.T) {
+	cxc := make(chan context.Context, 1)
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    No,
+			ReadBufferSize:  No,
+			WriteBufferSize: No,
+			BaseContext: func(net.Listener) context.Context {
+				return context.WithValue(context.Background(),
+					ctxKey("base"), 1)
+			},
+			ConnContext: func(cx context.Context,
+				c net.Conn) context.Context {
+
+				return context.WithValue(cx, ctxKey("conn"), 2)
+			},
+			Handlers: []Handler{
+				func(ctx *Context) {
+					cx := ctx.Context()
+					if cx.Value(ctxKey("base")) != 1 {
+						t.Error("missing BaseContext value")
+					}
+					if cx.Value(ctxKey("conn")) != 2 {
+						t.Error("missing ConnContext value")
+					}
+					if cx.Err() != nil {
+						t.Error("context.Context is cancelled too early")
+					}
+					cxc <- cx
+				},
+			},
+		}
+	})
+	defer g.Close()
+	conn, err := open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case cx := <-cxc:
+		select {
+		case <-cx.Done():
+		case <-time.After(5 * time.Second):
+			t.Error("context.Context is not cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler is not called")
+	}
+}
+
+func TestContext_Context_shutdown(t *testing.T) {
+	var (
+		blocked   = make(chan struct{})
+		cancelled = make(chan error, 1)
+	)
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:     listenOn,
+			ErrorLog: discardLogger(),
+			Handlers: []Handler{
+				func(ctx *Context) {
+					close(blocked)
+					<-ctx.Context().Done() // an outbound RPC
+					cancelled <- ctx.Context().Err()
+				},
+			},
+		}
+	})
+	conn, err := open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-blocked
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = g.Shutdown(ctx); err != nil {
+		t.Fatal("shutdown error:", err)
+	}
+	if drained, killed := g.ShutdownStat(); drained != 1 || killed != 0 {
+		t.Errorf("wrong stat: drained %d, killed %d", drained, killed)
+	}
+	if err = <-cancelled; err != context.Canceled {
+		t.Error("unexpected context error:", err)
+	}
+}
+
+func TestContext_AbortNext(t *testing.T) {
+	var (
+		order []int
+		errc  = make(chan error, 1)
+		fail  = errors.New("fail")
+	)
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    No,
+			ReadBufferSize:  No,
+			WriteBufferSize: No,
+			Handlers: []Handler{
+				func(ctx *Context) {
+					order = append(order, 0)
+					ctx.Next()
+					order = append(order, 3)
+				},
+				func(ctx *Context) {
+					order = append(order, 1)
+				},
+				ErrHandler(func(ctx *Context) error {
+					order = append(order, 2)
+					return fail
+				}).Handler(),
+				func(ctx *Context) {
+					t.Error("aborted chain is continued")
+				},
+			},
+			ErrorHandler: func(ctx *Context, err error) {
+				if !ctx.IsAborted() {
+					t.Error("chain is not aborted")
+				}
+				if ctx.Context().Err() == nil {
+					t.Error("context.Context is not cancelled")
+				}
+				errc <- err
+			},
+		}
+	})
+	defer g.Close()
+	conn, err := open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case err := <-errc:
+		if err != fail {
+			t.Errorf("wrong error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ErrorHandler is not called")
+	}
+	if fmt.Sprint(order) != "[0 1 2 3]" {
+		t.Errorf("wrong order: %v", order)
+	}
+}
+
 type dummyListener struct {
 	count int
 }
@@ -603,6 +1025,22 @@ func TestServer_limitWorkers(t *testing.T) {
 	}
 }
 
+func mustListen(t testing.TB, n, a string) net.Listener {
+	l, err := net.Listen(n, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func discardLogger() *log.Logger {
+	return log.New(ioutil.Discard, "", 0)
+}
+
+func discardSlog() *slog.Logger {
+	return slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+}
+
 func tlsConfig(t *testing.T) *tls.Config {
 	cert, err := tls.X509KeyPair([]byte(`-----BEGIN CERTIFICATE-----
 MIICEzCCAXygAwIBAgIQMIMChMLGrR+QvmQvpwAU6zANBgkqhkiG9w0BAQsFADAS
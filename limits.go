@@ -0,0 +1,287 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// internal defaults of per-IP limits
+const (
+	defaultCIDRPrefixV4 = 24
+	defaultCIDRPrefixV6 = 64
+
+	rejectTimeout     time.Duration = 1 * time.Second // banner write timeout
+	rejectWriters                   = 16              // banners written at once
+	rejectLogInterval               = 1 * time.Second // one rejection record per
+
+	bucketsSweepLen      = 1024            // sweep buckets if more
+	bucketsSweepInterval = 1 * time.Minute // but not often
+)
+
+// a rejectLog limits rate of records of rejected connections
+type rejectLog struct {
+	mu      sync.Mutex
+	last    time.Time // last record
+	skipped int       // rejections not logged since the last record
+}
+
+// is a record allowed, it returns number of rejections not logged
+// since the last record
+func (r *rejectLog) allow(now time.Time) (skipped int, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.last.IsZero() && now.Sub(r.last) < rejectLogInterval {
+		r.skipped++
+		return
+	}
+	skipped, r.skipped, r.last = r.skipped, 0, now
+	return skipped, true
+}
+
+// a token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take a token, the rate is tokens per second, the burst is
+// size of the bucket
+func (b *bucket) take(now time.Time, rate float64, burst int) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// is the bucket full at given time
+func (b *bucket) full(now time.Time, rate float64, burst int) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= float64(burst)
+}
+
+// per-IP and per-CIDR limits state of a server
+type ipLimiter struct {
+	mu        sync.Mutex
+	ips       map[string]int     // connections per IP
+	nets      map[string]int     // connections per network
+	buckets   map[string]*bucket // new connections rate per IP
+	lastSweep time.Time
+}
+
+// check per-IP limits values
+func (s *Server) checkIPLimits() (err error) {
+	debugf("(*Server).checkIPLimits")
+	switch {
+	case s.MaxConnsPerIP < 0:
+		err = fmt.Errorf("negative (*Server).MaxConnsPerIP: %d",
+			s.MaxConnsPerIP)
+	case s.MaxConnsPerCIDR < 0:
+		err = fmt.Errorf("negative (*Server).MaxConnsPerCIDR: %d",
+			s.MaxConnsPerCIDR)
+	case s.CIDRPrefixV4 < 0 || s.CIDRPrefixV4 > 32:
+		err = fmt.Errorf("invalid (*Server).CIDRPrefixV4: %d",
+			s.CIDRPrefixV4)
+	case s.CIDRPrefixV6 < 0 || s.CIDRPrefixV6 > 128:
+		err = fmt.Errorf("invalid (*Server).CIDRPrefixV6: %d",
+			s.CIDRPrefixV6)
+	case s.ConnRatePerIP < 0:
+		err = fmt.Errorf("negative (*Server).ConnRatePerIP: %v",
+			s.ConnRatePerIP)
+	case s.ConnBurstPerIP < 0:
+		err = fmt.Errorf("negative (*Server).ConnBurstPerIP: %d",
+			s.ConnBurstPerIP)
+	}
+	return
+}
+
+// are per-IP limits set
+func (s *Server) hasIPLimits() bool {
+	return s.MaxConnsPerIP > 0 || s.MaxConnsPerCIDR > 0 ||
+		s.ConnRatePerIP > 0
+}
+
+// IP address of given net.Addr or nil
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// network of the ip
+func (s *Server) ipNet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		prefix := s.CIDRPrefixV4
+		if prefix == 0 {
+			prefix = defaultCIDRPrefixV4
+		}
+		return ip4.Mask(net.CIDRMask(prefix, 32)).String()
+	}
+	prefix := s.CIDRPrefixV6
+	if prefix == 0 {
+		prefix = defaultCIDRPrefixV6
+	}
+	return ip.Mask(net.CIDRMask(prefix, 128)).String()
+}
+
+// burst of per-IP rate limit
+func (s *Server) connBurst() int {
+	if s.ConnBurstPerIP > 0 {
+		return s.ConnBurstPerIP
+	}
+	if burst := int(s.ConnRatePerIP); burst > 1 {
+		return burst
+	}
+	return 1
+}
+
+// admit a connection with given address, it returns keys to release
+// the connection or reason of rejection
+func (s *Server) admit(addr net.Addr) (ipKey, netKey, reason string) {
+	debugf("(*Server).admit: %v", addr)
+	if !s.hasIPLimits() {
+		return
+	}
+	var ip = addrIP(addr)
+	if ip == nil {
+		return // not an IP connection, no limits
+	}
+	var lim = &s.ipLim
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	ipKey, netKey = ip.String(), s.ipNet(ip)
+	if s.MaxConnsPerIP > 0 && lim.ips[ipKey] >= s.MaxConnsPerIP {
+		return "", "", "too many connections from IP"
+	}
+	if s.MaxConnsPerCIDR > 0 && lim.nets[netKey] >= s.MaxConnsPerCIDR {
+		return "", "", "too many connections from network"
+	}
+	if s.ConnRatePerIP > 0 {
+		var now = time.Now()
+		s.sweepBuckets(now)
+		b, ok := lim.buckets[ipKey]
+		if !ok {
+			if lim.buckets == nil {
+				lim.buckets = make(map[string]*bucket)
+			}
+			b = &bucket{tokens: float64(s.connBurst()), last: now}
+			lim.buckets[ipKey] = b
+		}
+		if !b.take(now, s.ConnRatePerIP, s.connBurst()) {
+			return "", "", "connection rate limit exceeded"
+		}
+	}
+	if lim.ips == nil {
+		lim.ips = make(map[string]int)
+		lim.nets = make(map[string]int)
+	}
+	lim.ips[ipKey]++
+	lim.nets[netKey]++
+	return
+}
+
+// drop full buckets, must be called under lock
+func (s *Server) sweepBuckets(now time.Time) {
+	var lim = &s.ipLim
+	if len(lim.buckets) < bucketsSweepLen ||
+		now.Sub(lim.lastSweep) < bucketsSweepInterval {
+		return
+	}
+	debugf("(*Server).sweepBuckets")
+	lim.lastSweep = now
+	for key, b := range lim.buckets {
+		if b.full(now, s.ConnRatePerIP, s.connBurst()) {
+			delete(lim.buckets, key)
+		}
+	}
+}
+
+// release admitted connection
+func (s *Server) release(ipKey, netKey string) {
+	debugf("(*Server).release: %s", ipKey)
+	if ipKey == "" {
+		return // not limited
+	}
+	var lim = &s.ipLim
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	if lim.ips[ipKey]--; lim.ips[ipKey] <= 0 {
+		delete(lim.ips, ipKey)
+	}
+	if lim.nets[netKey]--; lim.nets[netKey] <= 0 {
+		delete(lim.nets, netKey)
+	}
+}
+
+// reject a connection, the RejectBanner is written if set and there
+// are less than rejectWriters banners being written, otherwise the
+// connection is closed silently. Rejections are logged with warn
+// level, but not more often than rejectLogInterval
+func (s *Server) reject(conn net.Conn, reason string) {
+	debugf("(*Server).reject: %v", conn.RemoteAddr())
+	if skipped, ok := s.rejectLog.allow(time.Now()); ok {
+		s.log(slog.LevelWarn, "connection rejected",
+			"remote_addr", conn.RemoteAddr().String(), "reason", reason,
+			"skipped", skipped)
+	}
+	s.metrics().Rejected()
+	if len(s.RejectBanner) == 0 {
+		conn.Close()
+		return
+	}
+	if atomic.AddInt32(&s.rejecting, 1) > rejectWriters {
+		atomic.AddInt32(&s.rejecting, -1)
+		conn.Close() // flood
+		return
+	}
+	// don't block the accept loop
+	go func(banner []byte) {
+		defer atomic.AddInt32(&s.rejecting, -1)
+		conn.SetWriteDeadline(time.Now().Add(rejectTimeout))
+		conn.Write(banner)
+		conn.Close()
+	}(s.RejectBanner)
+}
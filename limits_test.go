@@ -0,0 +1,211 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func TestServer_MaxConnsPerIP(t *testing.T) {
+	banner := []byte("busy\n")
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    No,
+			ReadBufferSize:  No,
+			WriteBufferSize: No,
+			MaxConnsPerIP:   1,
+			RejectBanner:    banner,
+			ErrorLog:        discardLogger(),
+			Handlers: []Handler{
+				func(ctx *Context) {
+					io.Copy(ioutil.Discard, ctx) // until closed
+				},
+			},
+		}
+	})
+	defer g.Close()
+	first, err := open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for g.s.activeCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	reply, err := recvAll(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != string(banner) {
+		t.Errorf("wrong reply: %q", reply)
+	}
+	first.Close()
+	for g.s.activeCount() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// released
+	second, err := open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	for g.s.activeCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServer_ConnRatePerIP(t *testing.T) {
+	var m PromMetrics
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    No,
+			ReadBufferSize:  No,
+			WriteBufferSize: No,
+			ConnRatePerIP:   0.001,
+			ErrorLog:        discardLogger(),
+			Metrics:         &m,
+		}
+	})
+	defer g.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := recvAll(ln.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	accepted, rejected := atomic.LoadUint64(&m.accepted),
+		atomic.LoadUint64(&m.rejected)
+	if accepted != 2 || rejected != 1 {
+		t.Errorf("wrong metrics: accepted %d, rejected %d", accepted,
+			rejected)
+	}
+}
+
+func TestServer_reject(t *testing.T) {
+	var logs syncBuffer
+	s := &Server{
+		RejectBanner: []byte("busy\n"),
+		ErrorLog:     log.New(&logs, "", 0),
+	}
+	s.rejecting = rejectWriters // flood
+	client, conn := net.Pipe()
+	defer client.Close()
+	s.reject(conn, "test")
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := client.Read(make([]byte, 8)); err != io.EOF {
+		t.Errorf("unexpected banner: %d, %v", n, err)
+	}
+	if s.rejecting != rejectWriters {
+		t.Error("wrong number of banner writers:", s.rejecting)
+	}
+	if !strings.Contains(logs.String(), "connection rejected") {
+		t.Errorf("rejection is not logged: %q", logs.String())
+	}
+	// not flood
+	s.rejecting = 0
+	client, conn = net.Pipe()
+	defer client.Close()
+	s.reject(conn, "test")
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if reply, err := io.ReadAll(client); string(reply) != "busy\n" ||
+		err != nil {
+		t.Errorf("unexpected banner: %q, %v", reply, err)
+	}
+	for atomic.LoadInt32(&s.rejecting) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if n := strings.Count(logs.String(), "connection rejected"); n != 1 {
+		t.Errorf("rejection records are not limited: %d", n)
+	}
+}
+
+func Test_rejectLog(t *testing.T) {
+	var (
+		r   rejectLog
+		now = time.Now()
+	)
+	for i, tt := range []struct {
+		after   time.Duration
+		skipped int
+		ok      bool
+	}{
+		{0, 0, true},
+		{time.Millisecond, 0, false},
+		{rejectLogInterval / 2, 0, false},
+		{rejectLogInterval, 2, true},
+		{rejectLogInterval + time.Millisecond, 0, false},
+		{3 * rejectLogInterval, 1, true},
+	} {
+		skipped, ok := r.allow(now.Add(tt.after))
+		if skipped != tt.skipped || ok != tt.ok {
+			t.Errorf("%d: unexpected %d, %v", i, skipped, ok)
+		}
+	}
+}
+
+func TestServer_checkIPLimits(t *testing.T) {
+	for _, s := range []*Server{
+		{MaxConnsPerIP: -1},
+		{MaxConnsPerCIDR: -1},
+		{CIDRPrefixV4: 33},
+		{CIDRPrefixV6: -1},
+		{ConnRatePerIP: -1},
+		{ConnBurstPerIP: -1},
+	} {
+		if err := s.checkIPLimits(); err == nil {
+			t.Errorf("missing error: %+v", s)
+		}
+	}
+}
+
+func TestServer_ipNet(t *testing.T) {
+	s := Server{CIDRPrefixV4: 16}
+	if n := s.ipNet(net.ParseIP("10.1.2.3")); n != "10.1.0.0" {
+		t.Errorf("wrong IPv4 network: %s", n)
+	}
+	if n := s.ipNet(net.ParseIP("2001:db8::1:2:3:4")); n != "2001:db8::" {
+		t.Errorf("wrong IPv6 network: %s", n)
+	}
+}
+
+func Test_bucket(t *testing.T) {
+	now := time.Now()
+	b := bucket{tokens: 2, last: now}
+	if !b.take(now, 1, 2) || !b.take(now, 1, 2) || b.take(now, 1, 2) {
+		t.Error("wrong burst")
+	}
+	if !b.take(now.Add(time.Second), 1, 2) {
+		t.Error("missing refill")
+	}
+}
@@ -0,0 +1,247 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ErrLineTooLong is returned by (*Context).ReadLine if a line is
+// longer than the (*Server).Line.MaxLength
+var ErrLineTooLong = errors.New("line too long")
+
+// DefaultMaxLineLength is default maximum length of a line
+const DefaultMaxLineLength = 4096
+
+// A FlushPolicy is when the (*Context).WriteLine flushes buffered
+// connection
+type FlushPolicy int
+
+// flush policies
+const (
+	FlushManual FlushPolicy = iota // never, call (*Context).Flush
+	FlushAlways                    // after every line
+	FlushIdle                      // if no buffered input (pipelining)
+)
+
+var flushPolicies = [...]string{
+	FlushManual: "manual",
+	FlushAlways: "always",
+	FlushIdle:   "idle",
+}
+
+// String implements fmt.Stringer interface
+func (f FlushPolicy) String() string {
+	if f >= 0 && int(f) < len(flushPolicies) {
+		return flushPolicies[f]
+	}
+	return "FlushPolicy(" + fmt.Sprint(int(f)) + ")"
+}
+
+// LineOptions describe lines of the (*Context).ReadLine and WriteLine
+type LineOptions struct {
+	// MaxLength is maximum length of a line, excluding the line
+	// ending. Use Default for DefaultMaxLineLength or No for no limit
+	MaxLength int
+	// LF makes the WriteLine to end lines with "\n" instead of "\r\n"
+	LF bool
+	// Flush is the WriteLine flush policy
+	Flush FlushPolicy
+}
+
+// check the options
+func (o *LineOptions) check() (err error) {
+	debugf("(*LineOptions).check")
+	switch {
+	case o.MaxLength < No:
+		err = fmt.Errorf("negative (*Server).Line.MaxLength: %d",
+			o.MaxLength)
+	case o.Flush < 0 || int(o.Flush) >= len(flushPolicies):
+		err = fmt.Errorf("unknown (*Server).Line.Flush: %v", o.Flush)
+	}
+	return
+}
+
+// maximum length of a line
+func (o *LineOptions) maxLength() int {
+	switch o.MaxLength {
+	case Default:
+		return DefaultMaxLineLength
+	case No:
+		return math.MaxInt
+	}
+	return o.MaxLength
+}
+
+// a lineReader is buffered reader of the Context, the *bufio.Reader
+// or the *lazyReader; its Peek fills empty buffer
+type lineReader interface {
+	Buffered() int
+	Peek(n int) ([]byte, error)
+	Discard(n int) (int, error)
+}
+
+var (
+	crlf = []byte("\r\n")
+	lf   = crlf[1:]
+)
+
+// trim line ending, the line ends with '\n'
+func trimLine(line []byte) []byte {
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line
+}
+
+// is line without ending longer than the max, the line ends with
+// '\n' if the end is true
+func lineTooLong(line []byte, max int, end bool) bool {
+	if end {
+		return len(trimLine(line)) > max
+	}
+	// the last "\r" can be part of "\r\n"
+	return len(line)-1 > max ||
+		len(line) > max && line[len(line)-1] != '\r'
+}
+
+// read line from the buffered reader, the returned line refers to the
+// buffer if the alias is true, otherwise it's copied to the c.line;
+// it returns number of read bytes
+func (c *Context) readLineFrom(rd lineReader, alias bool, max int) (
+	line []byte, n int, err error) {
+
+	for {
+		var b []byte
+		if _, err = rd.Peek(1); err != nil {
+			return nil, n, err
+		}
+		b, _ = rd.Peek(rd.Buffered())
+		var end bool
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			b, end = b[:i+1], true
+		}
+		if alias && end && len(c.line) == 0 {
+			line = b // refer to the buffer
+		} else {
+			c.line = append(c.line, b...)
+			line = c.line
+		}
+		rd.Discard(len(b))
+		if n += len(b); lineTooLong(line, max, end) {
+			return nil, n, ErrLineTooLong
+		}
+		if end {
+			return trimLine(line), n, nil
+		}
+	}
+}
+
+// read line from not buffered connection byte by byte
+func (c *Context) readLineByte(max int) (line []byte, n int, err error) {
+	for {
+		c.line = append(c.line, 0)
+		var m int
+		if m, err = c.in.Read(c.line[len(c.line)-1:]); m == 0 {
+			c.line = c.line[:len(c.line)-1]
+			if err != nil {
+				return
+			}
+			continue
+		}
+		n++
+		var end = c.line[len(c.line)-1] == '\n'
+		if lineTooLong(c.line, max, end) {
+			return nil, n, ErrLineTooLong
+		}
+		if end {
+			return trimLine(c.line), n, nil
+		}
+	}
+}
+
+// ReadLine reads a line ending with "\r\n" or "\n", the ending is not
+// included. The line is valid until next read. For buffered connection
+// it refers to the read buffer if it fits, otherwise it's copied to a
+// reused buffer of the Context. Not buffered connection is read byte
+// by byte. If the line is longer than the (*Server).Line.MaxLength,
+// the ErrLineTooLong is returned and the connection should be closed,
+// since it's out of sync. The io.EOF is returned only if the connection
+// is closed between lines
+func (c *Context) ReadLine() (line []byte, err error) {
+	if err = c.startRead(); err != nil {
+		return
+	}
+	var (
+		max = c.srv.Line.maxLength()
+		n   int
+	)
+	c.line = c.line[:0]
+	switch {
+	case c.bin != nil && c.in == io.Reader(c.bin):
+		line, n, err = c.readLineFrom(c.bin, true, max)
+	case c.lin != nil && c.in == io.Reader(c.lin):
+		line, n, err = c.readLineFrom(c.lin, false, max)
+	default:
+		line, n, err = c.readLineByte(max)
+	}
+	c.doneRead(n)
+	if n > 0 && err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// WriteLine writes the line and "\r\n", or "\n" if the LF option is
+// set. Then buffered connection is flushed according to the
+// (*Server).Line.Flush policy
+func (c *Context) WriteLine(line []byte) (err error) {
+	var o = &c.srv.Line
+	if _, err = c.Write(line); err != nil {
+		return
+	}
+	var end = crlf
+	if o.LF {
+		end = lf
+	}
+	if _, err = c.Write(end); err != nil {
+		return
+	}
+	switch o.Flush {
+	case FlushAlways:
+		err = c.Flush()
+	case FlushIdle:
+		if c.buffered() == 0 {
+			err = c.Flush() // no pipelined input
+		}
+	}
+	return
+}
@@ -0,0 +1,249 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// a line read by the hLines
+type readLine struct {
+	line string
+	err  error
+}
+
+// send read lines to the lines, until an error
+func hLines(lines chan<- readLine) Handler {
+	return func(ctx *Context) {
+		for {
+			line, err := ctx.ReadLine()
+			lines <- readLine{string(line), err}
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serve the s with the hLines, write the input and close connection
+func serveLines(t *testing.T, s *Server, input string) <-chan readLine {
+	var (
+		lines = make(chan readLine, 10)
+		g     Grace
+	)
+	s.Handlers = []Handler{hLines(lines)}
+	s.ErrorLog = discardLogger()
+	g.ServeAll(s, mustListen(t, "tcp", "127.0.0.1:0"))
+	t.Cleanup(func() { g.Close() })
+	conn, err := net.Dial("tcp", g.ls[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for len(input) > 0 { // by small pieces
+		var n = len(input)
+		if n > 7 {
+			n = 7
+		}
+		conn.Write([]byte(input[:n]))
+		input = input[n:]
+		time.Sleep(time.Millisecond)
+	}
+	conn.Close()
+	return lines
+}
+
+func TestContext_ReadLine(t *testing.T) {
+	var long = strings.Repeat("x", 100)
+	for _, tt := range []struct {
+		name string
+		srv  *Server
+	}{
+		{"buffered", &Server{}},
+		{"small buffer", &Server{ReadBufferSize: 16}},
+		{"not buffered", &Server{ReadBufferSize: No}},
+		{"buffer pool", &Server{BufferPool: NewBufferPool(Default),
+			ReadBufferSize: 16}},
+	} {
+		tt.srv.Line.MaxLength = 100
+		lines := serveLines(t, tt.srv, "hello\r\nworld\n\r\n"+long+"\r\n"+
+			long+"\nlast")
+		for _, want := range []readLine{
+			{"hello", nil},
+			{"world", nil},
+			{"", nil},
+			{long, nil},
+			{long, nil},
+			{"", io.ErrUnexpectedEOF},
+		} {
+			if got := <-lines; got != want {
+				t.Errorf("%s: want %q, %v, got %q, %v", tt.name, want.line,
+					want.err, got.line, got.err)
+			}
+		}
+	}
+}
+
+func TestContext_ReadLine_tooLong(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		input string
+		err   error
+	}{
+		{"too long", "hello!\r\n", ErrLineTooLong},
+		{"too long LF", "hello!\n", ErrLineTooLong},
+		{"too long CR", "hello\rx\n", ErrLineTooLong},
+		{"no line ending", "hello!", ErrLineTooLong},
+		{"closed", "", io.EOF},
+	} {
+		for _, bs := range []int{Default, 4, No} {
+			lines := serveLines(t, &Server{
+				ReadBufferSize: bs,
+				Line:           LineOptions{MaxLength: 5},
+			}, "hello\r\n"+tt.input)
+			if got := <-lines; got.line != "hello" || got.err != nil {
+				t.Errorf("%s (%d): unexpected line: %q, %v", tt.name, bs,
+					got.line, got.err)
+			}
+			if got := <-lines; got.err != tt.err {
+				t.Errorf("%s (%d): unexpected error: %v", tt.name, bs,
+					got.err)
+			}
+		}
+	}
+}
+
+func TestContext_ReadLine_allocs(t *testing.T) {
+	var (
+		allocs = make(chan float64, 1)
+		g      Grace
+	)
+	g.ServeAll(&Server{
+		Handlers: []Handler{func(ctx *Context) {
+			allocs <- testing.AllocsPerRun(100, func() {
+				if _, err := ctx.ReadLine(); err != nil {
+					panic(err)
+				}
+			})
+		}},
+		ErrorLog: discardLogger(),
+	}, mustListen(t, "tcp", "127.0.0.1:0"))
+	defer g.Close()
+	conn, err := net.Dial("tcp", g.ls[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(strings.Repeat("GET key\r\n", 101)))
+	if n := <-allocs; n != 0 {
+		t.Errorf("ReadLine allocates: %v", n)
+	}
+}
+
+func TestContext_WriteLine(t *testing.T) {
+	for _, tt := range []struct {
+		opts    LineOptions
+		flushed bool // after the first line
+	}{
+		{LineOptions{}, false},
+		{LineOptions{Flush: FlushAlways}, true},
+		{LineOptions{Flush: FlushIdle}, false},
+		{LineOptions{Flush: FlushIdle, LF: true}, false},
+	} {
+		var (
+			wrote = make(chan struct{})
+			next  = make(chan struct{})
+			g     Grace
+		)
+		g.ServeAll(&Server{
+			Line: tt.opts,
+			Handlers: []Handler{func(ctx *Context) {
+				for i := 0; i < 2; i++ {
+					line, err := ctx.ReadLine()
+					if err != nil {
+						return
+					}
+					ctx.WriteLine(line)
+					if i == 0 {
+						wrote <- struct{}{}
+						<-next
+					}
+				}
+				ctx.Flush()
+			}},
+			ErrorLog: discardLogger(),
+		}, mustListen(t, "tcp", "127.0.0.1:0"))
+		conn, err := net.Dial("tcp", g.ls[0].Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("one\r\ntwo\r\n")) // pipelined
+		<-wrote
+		var end = "\r\n"
+		if tt.opts.LF {
+			end = "\n"
+		}
+		var reply = make([]byte, 3+len(end))
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err = io.ReadFull(conn, reply)
+		if tt.flushed && (err != nil || string(reply) != "one"+end) {
+			t.Errorf("%v: not flushed: %q, %v", tt.opts.Flush, reply, err)
+		} else if !tt.flushed && err == nil {
+			t.Errorf("%v: unexpected flush: %q", tt.opts.Flush, reply)
+		}
+		close(next)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var want = "one" + end + "two" + end
+		if tt.flushed {
+			want = "two" + end
+		}
+		reply = make([]byte, len(want))
+		if _, err = io.ReadFull(conn, reply); err != nil ||
+			string(reply) != want {
+			t.Errorf("%v: unexpected reply: %q, %v", tt.opts.Flush, reply,
+				err)
+		}
+		conn.Close()
+		g.Close()
+	}
+}
+
+func TestServer_Line(t *testing.T) {
+	for _, opts := range []LineOptions{
+		{MaxLength: -2},
+		{Flush: -1},
+		{Flush: 3},
+	} {
+		s := &Server{Line: opts}
+		if err := s.Serve(mustListen(t, "tcp", "127.0.0.1:0")); err == nil {
+			t.Errorf("missing error for %+v", opts)
+		}
+	}
+}
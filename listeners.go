@@ -0,0 +1,197 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"net"
+	"sync"
+)
+
+// A ListenerConfig describes a listener of a multi-listener server
+type ListenerConfig struct {
+	// Net is "tcp", "tcp4", "tcp6", "unix" or "unixpacket", defaults
+	// to "tcp"
+	Net string
+	// Addr is address to listen on, "0.0.0.0:3000" if empty
+	Addr string
+	// TLS turns on TLS, the (*Server).TLSConfig is used
+	TLS bool
+	// CertFile and KeyFile are optional certificate and key for TLS,
+	// see ListenAndServeTLS for details
+	CertFile, KeyFile string
+}
+
+// listen on all (*Server).Listeners or on Net and Addr
+func (s *Server) listenAll() (ls []net.Listener, err error) {
+	debugf("(*Server).listenAll")
+	if len(s.Listeners) == 0 {
+		return s.listen()
+	}
+	for _, lc := range s.Listeners {
+		var (
+			more []net.Listener
+			n, a = lc.Net, lc.Addr
+		)
+		if n == "" {
+			n = defaultNet
+		}
+		if a == "" {
+			a = defaultAddr
+		}
+		if lc.TLS {
+			more, err = s.listenTLSOn(n, a, lc.CertFile, lc.KeyFile)
+		} else {
+			more, err = s.listenAcceptors(n, a)
+		}
+		if err != nil {
+			closeListeners(ls)
+			return nil, err
+		}
+		ls = append(ls, more...)
+	}
+	return
+}
+
+// ListenAndServeAll listens on all (*Server).Listeners and then calls
+// ServeAll. If the Listeners is empty, the Net and Addr are used.
+// ListenAndServeAll always returns a non-nil error
+func (s *Server) ListenAndServeAll() error {
+	debugf("(*Server).ListenAndServeAll")
+	ls, err := s.listenAll()
+	if err != nil {
+		return err
+	}
+	return s.ServeAll(ls...)
+}
+
+// ServeAll serves given listeners, each in separate goroutine. All the
+// listeners share WorkersLimit, metrics and the contexts pool. If one
+// of the listeners fails, all other are closed. ServeAll returns
+// first error. ServeAll always returns a non-nil error
+func (s *Server) ServeAll(ls ...net.Listener) (err error) {
+	debugf("(*Server).ServeAll")
+	var (
+		wg   sync.WaitGroup
+		errc = make(chan error, len(ls))
+	)
+	for _, l := range ls {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			errc <- s.Serve(l)
+		}(l)
+	}
+	err = <-errc
+	for _, l := range ls {
+		l.Close()
+	}
+	wg.Wait()
+	return
+}
+
+// a limitListener limits number of simultaneous connections using
+// given semaphore, that can be shared between many listeners
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitListener(l net.Listener, sem chan struct{}) *limitListener {
+	debugf("newLimitListener")
+	return &limitListener{Listener: l, sem: sem, done: make(chan struct{})}
+}
+
+// acquire a worker, it returns false if the listener is closed, even
+// if there is a free worker
+func (l *limitListener) acquire() bool {
+	select {
+	case <-l.done:
+		return false
+	default:
+	}
+	select {
+	case <-l.done:
+		return false
+	case l.sem <- struct{}{}:
+	}
+	select {
+	case <-l.done:
+		l.release() // closed while waiting
+		return false
+	default:
+		return true
+	}
+}
+
+func (l *limitListener) release() { <-l.sem }
+
+// Accept implements net.Listener interface. Unlike the LimitListener
+// of golang.org/x/net/netutil, it accepts a connection first and then
+// waits for a worker. Otherwise, an idle listener holds a shared
+// worker while it's waiting for a connection. Note, that the accepted
+// connection waits for a worker without a deadline, until a worker is
+// free or the listener is closed
+func (l *limitListener) Accept() (net.Conn, error) {
+	debugf("(*limitListener).Accept")
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.acquire() {
+		c.Close()
+		return nil, net.ErrClosed
+	}
+	return &limitConn{Conn: c, release: l.release}, nil
+}
+
+// Close implements net.Listener interface
+func (l *limitListener) Close() error {
+	debugf("(*limitListener).Close")
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+// a limitConn releases its worker on Close
+type limitConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+// NetConn returns underlying connection
+func (l *limitConn) NetConn() net.Conn {
+	return l.Conn
+}
+
+// Close implements net.Conn interface
+func (l *limitConn) Close() error {
+	err := l.Conn.Close()
+	l.releaseOnce.Do(l.release)
+	return err
+}
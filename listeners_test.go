@@ -0,0 +1,134 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"io"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+func TestGrace_ListenAndServeAll(t *testing.T) {
+	data := []byte("Hello")
+	sock := filepath.Join(t.TempDir(), "gtss.sock")
+	s := &Server{
+		Listeners: []ListenerConfig{
+			{Addr: listenOn},
+			{Addr: listenOn, TLS: true},
+			{Net: "unix", Addr: sock},
+		},
+		WorkersLimit:    1,
+		ReadBufferSize:  No,
+		WriteBufferSize: No,
+		TLSConfig:       tlsConfig(t),
+		Handlers:        []Handler{hRecv(data, t)},
+	}
+	var g Grace
+	g.ListenAndServeAll(s)
+	if len(g.ls) != 3 {
+		t.Fatalf("wrong number of listeners: %d", len(g.ls))
+	}
+	// hold the only worker
+	hold, err := net.Dial("tcp", g.ls[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for s.activeCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	sent := make(chan error, 1)
+	go func() { sent <- sendTLS(g.ls[1].Addr().String(), data) }()
+	select {
+	case <-sent:
+		// the handshake can't complete, because the worker is busy
+		t.Fatal("WorkersLimit is not shared")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err = hold.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	hold.Close()
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	uc, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = uc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	uc.Close()
+	g.Close()
+	select {
+	case <-g.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not closed")
+	}
+	if g.Err() != nil {
+		t.Error("unexpected error:", g.Err())
+	}
+}
+
+type failListener struct{ net.Listener }
+
+func (failListener) Accept() (net.Conn, error) { return nil, io.ErrClosedPipe }
+
+func TestServer_ServeAll(t *testing.T) {
+	l, err := net.Listen("tcp", listenOn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl, err := net.Listen("tcp", listenOn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{WorkersLimit: No}
+	err = s.ServeAll(l, failListener{fl})
+	if err != io.ErrClosedPipe {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Error("listener is not closed")
+	}
+}
+
+func Test_limitListener_acquire(t *testing.T) {
+	l := newLimitListener(mustListen(t, "tcp", "127.0.0.1:0"),
+		make(chan struct{}, 1))
+	l.Close()
+	for i := 0; i < 100; i++ {
+		if l.acquire() {
+			t.Fatal("a worker is acquired after Close")
+		}
+	}
+	if len(l.sem) != 0 {
+		t.Error("worker is not released")
+	}
+}
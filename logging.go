@@ -0,0 +1,114 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// debug logger, *slog.Logger or nil
+var debugLog atomic.Value
+
+// SetDebugLogger sets logger for internal debug messages. The
+// messages are logged with slog.LevelDebug, thus level of the
+// logger's handler must allow them. Nil turns debug logging off.
+// It's safe to call the SetDebugLogger at runtime
+func SetDebugLogger(l *slog.Logger) {
+	debugLog.Store(l)
+}
+
+// log debug message; it's not called on per-I/O paths, since the
+// arguments are allocated even if debug logging is off
+func debugf(format string, args ...interface{}) {
+	if l, _ := debugLog.Load().(*slog.Logger); l != nil &&
+		l.Enabled(context.Background(), slog.LevelDebug) {
+
+		l.Debug(fmt.Sprintf(format, args...))
+	}
+}
+
+// attributes of the connection for structured logging
+// followed by given additional key-value pairs
+func (c *Context) logAttrs(args ...interface{}) []interface{} {
+	debugf("(*Context).logAttrs")
+	var addr string
+	if ra := c.RemoteAddr(); ra != nil {
+		addr = ra.String()
+	}
+	return append([]interface{}{
+		"conn_id", c.id,
+		"remote_addr", addr,
+		"handler", c.handler,
+	}, args...)
+}
+
+// log with given level, message and key-value pairs
+func (s *Server) log(level slog.Level, msg string, args ...interface{}) {
+	debugf("(*Server).log: %s", msg)
+	logTo(s.Logger, s.ErrorLog, level, msg, args...)
+}
+
+// log to the logger or, if it's nil, to the errorLog; if both are nil,
+// the standard logger is used; debug records aren't printed by the
+// errorLog
+func logTo(logger *slog.Logger, errorLog *log.Logger, level slog.Level,
+	msg string, args ...interface{}) {
+
+	if logger != nil {
+		logger.Log(context.Background(), level, msg, args...)
+		return
+	}
+	if level < slog.LevelInfo {
+		return // the ErrorLog is for errors
+	}
+	// the ErrorLog adapter
+	var (
+		b     strings.Builder
+		stack []byte
+	)
+	b.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		if p, ok := args[i+1].([]byte); ok && args[i] == "stack" {
+			stack = p // multiline, print it last
+			continue
+		}
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	if stack != nil {
+		b.WriteByte('\n')
+		b.Write(stack)
+	}
+	if errorLog != nil {
+		errorLog.Print(b.String())
+	} else {
+		log.Print(b.String())
+	}
+}
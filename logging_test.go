@@ -0,0 +1,107 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"errors"
+	"log"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+func TestServer_Logger(t *testing.T) {
+	var logs syncBuffer
+	closed := make(chan struct{})
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    No,
+			ReadBufferSize:  No,
+			WriteBufferSize: No,
+			Logger:          slog.New(slog.NewJSONHandler(&logs, nil)),
+			Handlers: []Handler{
+				func(ctx *Context) {
+					ctx.AbortWithError(errors.New("fail"))
+				},
+			},
+			ConnState: func(_ net.Conn, state ConnState) {
+				if state == StateClosed {
+					close(closed)
+				}
+			},
+		}
+	})
+	defer g.Close()
+	conn, err := open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection is not closed")
+	}
+	for _, want := range []string{
+		`"level":"ERROR"`,
+		`"msg":"error serving"`,
+		`"conn_id":1`,
+		`"remote_addr":"` + conn.LocalAddr().String() + `"`,
+		`"handler":0`,
+		`"error":"fail"`,
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("missing %s in %s", want, logs.String())
+		}
+	}
+}
+
+func TestServer_logErrorLog(t *testing.T) {
+	var logs strings.Builder
+	s := Server{ErrorLog: log.New(&logs, "", 0)}
+	s.log(slog.LevelError, "panic serving", "conn_id", 1, "stack",
+		[]byte("trace"))
+	if got := logs.String(); got != "panic serving conn_id=1\ntrace\n" {
+		t.Errorf("wrong ErrorLog output: %q", got)
+	}
+}
+
+func TestSetDebugLogger(t *testing.T) {
+	var logs strings.Builder
+	SetDebugLogger(slog.New(slog.NewTextHandler(&logs,
+		&slog.HandlerOptions{Level: slog.LevelDebug})))
+	debugf("hello %d", 1)
+	SetDebugLogger(nil)
+	debugf("bye")
+	if got := logs.String(); !strings.Contains(got, `msg="hello 1"`) ||
+		strings.Contains(got, "bye") {
+		t.Errorf("wrong debug output: %q", got)
+	}
+}
@@ -0,0 +1,305 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Metrics collects server metrics. Methods of the Metrics are
+// called from many goroutines at once
+type Metrics interface {
+	// Accepted is called when a connection accepted
+	Accepted()
+	// Rejected is called when a connection is closed right after
+	// accept, because of a limit or a filter
+	Rejected()
+	// Failed is called when a handlers chain aborted with an error
+	// or panicked
+	Failed()
+	// TempError is called on temporary accept error with backoff
+	// the error caused
+	TempError(backoff time.Duration)
+	// Panic is called when a panic of a handler is recovered
+	Panic()
+	// Active is called when number of in-flight connections changed.
+	// The limit is effective (*Server).WorkersLimit, it is No if
+	// there is no limit
+	Active(active, limit int)
+	// Closed is called when a connection closed with its lifetime
+	Closed(duration time.Duration)
+	// Read is called with number of bytes read through a Context
+	Read(n int)
+	// Written is called with number of bytes written through a Context
+	Written(n int)
+}
+
+// A PoolMetrics is optional extension of the Metrics, that collects
+// metrics of worker pool, see (*Server).PoolWorkers
+type PoolMetrics interface {
+	// Queue is called when depth of the queue or number of workers
+	// changed. The depth is number of connections waiting for a worker
+	Queue(depth, workers int)
+	// Waited is called when a worker takes a connection with time the
+	// connection waited in the queue
+	Waited(wait time.Duration)
+}
+
+// metrics or no-op
+func (s *Server) metrics() Metrics {
+	if s.Metrics != nil {
+		return s.Metrics
+	}
+	return nopMetrics{}
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Accepted()               {}
+func (nopMetrics) Rejected()               {}
+func (nopMetrics) Failed()                 {}
+func (nopMetrics) TempError(time.Duration) {}
+func (nopMetrics) Panic()                  {}
+func (nopMetrics) Active(int, int)         {}
+func (nopMetrics) Closed(time.Duration)    {}
+func (nopMetrics) Read(int)                {}
+func (nopMetrics) Written(int)             {}
+
+// default histograms buckets, in seconds
+var (
+	// DurationBuckets used for connections duration
+	DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5,
+		5, 10, 30, 60, 300}
+	// BackoffBuckets used for temporary accept errors backoff
+	BackoffBuckets = []float64{.005, .01, .02, .04, .08, .16, .32, .64, 1}
+	// WaitBuckets used for time connections wait for a worker
+	WaitBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1,
+		5}
+)
+
+// A histogram is simple cumulative histogram
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64 // upper bounds
+	counts  []uint64  // per bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.buckets == nil {
+		h.buckets = buckets
+		h.counts = make([]uint64, len(buckets))
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// A PromMetrics is default Metrics implementation that writes
+// collected metrics in Prometheus text exposition format. Zero
+// value is ready to use. A PromMetrics should not be shared
+// between servers
+type PromMetrics struct {
+	// atomic counters, keep them first for 64-bit alignment
+	accepted, rejected, failed, tempErrors, panics uint64
+	read, written                                  uint64
+	active, limit                                  int64
+	depth, workers                                 int64
+
+	// Namespace is prefix of metrics names, "gtss" if empty
+	Namespace string
+
+	duration, backoff, wait histogram
+}
+
+// Accepted implements Metrics interface
+func (p *PromMetrics) Accepted() { atomic.AddUint64(&p.accepted, 1) }
+
+// Rejected implements Metrics interface
+func (p *PromMetrics) Rejected() { atomic.AddUint64(&p.rejected, 1) }
+
+// Failed implements Metrics interface
+func (p *PromMetrics) Failed() { atomic.AddUint64(&p.failed, 1) }
+
+// TempError implements Metrics interface
+func (p *PromMetrics) TempError(backoff time.Duration) {
+	atomic.AddUint64(&p.tempErrors, 1)
+	p.backoff.observe(BackoffBuckets, backoff.Seconds())
+}
+
+// Panic implements Metrics interface
+func (p *PromMetrics) Panic() { atomic.AddUint64(&p.panics, 1) }
+
+// Active implements Metrics interface
+func (p *PromMetrics) Active(active, limit int) {
+	atomic.StoreInt64(&p.active, int64(active))
+	atomic.StoreInt64(&p.limit, int64(limit))
+}
+
+// Closed implements Metrics interface
+func (p *PromMetrics) Closed(duration time.Duration) {
+	p.duration.observe(DurationBuckets, duration.Seconds())
+}
+
+// Read implements Metrics interface
+func (p *PromMetrics) Read(n int) { atomic.AddUint64(&p.read, uint64(n)) }
+
+// Written implements Metrics interface
+func (p *PromMetrics) Written(n int) { atomic.AddUint64(&p.written, uint64(n)) }
+
+// Queue implements PoolMetrics interface
+func (p *PromMetrics) Queue(depth, workers int) {
+	atomic.StoreInt64(&p.depth, int64(depth))
+	atomic.StoreInt64(&p.workers, int64(workers))
+}
+
+// Waited implements PoolMetrics interface
+func (p *PromMetrics) Waited(wait time.Duration) {
+	p.wait.observe(WaitBuckets, wait.Seconds())
+}
+
+// a promWriter writes metrics in Prometheus text format
+type promWriter struct {
+	ns string
+	bw *bufio.Writer
+}
+
+func (w *promWriter) header(name, typ, help string) {
+	w.bw.WriteString("# HELP " + w.ns + name + " " + help + "\n")
+	w.bw.WriteString("# TYPE " + w.ns + name + " " + typ + "\n")
+}
+
+func (w *promWriter) value(name, typ, help string, v string) {
+	w.header(name, typ, help)
+	w.bw.WriteString(w.ns + name + " " + v + "\n")
+}
+
+func (w *promWriter) counter(name, help string, v uint64) {
+	w.value(name, "counter", help, strconv.FormatUint(v, 10))
+}
+
+func (w *promWriter) gauge(name, help string, v int64) {
+	w.value(name, "gauge", help, strconv.FormatInt(v, 10))
+}
+
+func (w *promWriter) histogram(name, help string, h *histogram,
+	buckets []float64) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.buckets != nil {
+		buckets = h.buckets // the buckets used
+	}
+	w.header(name, "histogram", help)
+	var cumulative uint64
+	for i, le := range buckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		w.bw.WriteString(w.ns + name + `_bucket{le="` +
+			strconv.FormatFloat(le, 'g', -1, 64) + `"} ` +
+			strconv.FormatUint(cumulative, 10) + "\n")
+	}
+	w.bw.WriteString(w.ns + name + `_bucket{le="+Inf"} ` +
+		strconv.FormatUint(h.count, 10) + "\n")
+	w.bw.WriteString(w.ns + name + "_sum " +
+		strconv.FormatFloat(h.sum, 'g', -1, 64) + "\n")
+	w.bw.WriteString(w.ns + name + "_count " +
+		strconv.FormatUint(h.count, 10) + "\n")
+}
+
+// countWriter counts bytes written
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += int64(n)
+	return
+}
+
+// WriteTo writes all metrics to given writer in Prometheus text
+// exposition format. It implements io.WriterTo interface
+func (p *PromMetrics) WriteTo(w io.Writer) (n int64, err error) {
+	debugf("(*PromMetrics).WriteTo")
+	var (
+		cw = &countWriter{w: w}
+		pw = &promWriter{ns: p.Namespace, bw: bufio.NewWriter(cw)}
+	)
+	if pw.ns == "" {
+		pw.ns = "gtss"
+	}
+	pw.ns += "_"
+	pw.counter("connections_accepted_total", "Accepted connections.",
+		atomic.LoadUint64(&p.accepted))
+	pw.counter("connections_rejected_total",
+		"Connections rejected right after accept.",
+		atomic.LoadUint64(&p.rejected))
+	pw.counter("connections_failed_total",
+		"Connections with a handler error or panic.",
+		atomic.LoadUint64(&p.failed))
+	pw.counter("accept_temporary_errors_total",
+		"Temporary accept errors.", atomic.LoadUint64(&p.tempErrors))
+	pw.histogram("accept_backoff_seconds",
+		"Backoff caused by temporary accept errors.", &p.backoff,
+		BackoffBuckets)
+	pw.counter("panics_recovered_total", "Recovered handlers panics.",
+		atomic.LoadUint64(&p.panics))
+	pw.gauge("connections_active", "In-flight connections.",
+		atomic.LoadInt64(&p.active))
+	pw.gauge("workers_limit",
+		"Maximum simultaneous connections, -1 means no limit.",
+		atomic.LoadInt64(&p.limit))
+	pw.histogram("connection_duration_seconds",
+		"Lifetime of closed connections.", &p.duration, DurationBuckets)
+	pw.counter("read_bytes_total", "Bytes read through Context.",
+		atomic.LoadUint64(&p.read))
+	pw.counter("written_bytes_total", "Bytes written through Context.",
+		atomic.LoadUint64(&p.written))
+	pw.gauge("pool_queue_depth", "Connections waiting for a worker.",
+		atomic.LoadInt64(&p.depth))
+	pw.gauge("pool_workers", "Workers of worker pool.",
+		atomic.LoadInt64(&p.workers))
+	pw.histogram("pool_wait_seconds",
+		"Time connections waited for a worker.", &p.wait, WaitBuckets)
+	err = pw.bw.Flush()
+	return cw.n, err
+}
@@ -0,0 +1,116 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"bytes"
+	"net"
+	"strings"
+	"time"
+)
+
+func TestPromMetrics(t *testing.T) {
+	data := []byte("Hello")
+	var m PromMetrics
+	closed := make(chan struct{})
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    10,
+			ReadBufferSize:  No,
+			WriteBufferSize: No,
+			Metrics:         &m,
+			ErrorLog:        discardLogger(),
+			Handlers: []Handler{
+				hRecv(data, t),
+				func(ctx *Context) {
+					panic("boom")
+				},
+			},
+			ConnState: func(_ net.Conn, state ConnState) {
+				if state == StateClosed {
+					close(closed)
+				}
+			},
+		}
+	})
+	defer g.Close()
+	if err := send(ln.Addr().String(), data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection is not closed")
+	}
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("wrong number of bytes written: %d", n)
+	}
+	for _, want := range []string{
+		"# TYPE gtss_connections_accepted_total counter\n",
+		"gtss_connections_accepted_total 1\n",
+		"gtss_connections_failed_total 1\n",
+		"gtss_panics_recovered_total 1\n",
+		"gtss_connections_active 0\n",
+		"gtss_workers_limit 10\n",
+		"gtss_read_bytes_total 5\n",
+		"gtss_written_bytes_total 0\n",
+		"# TYPE gtss_connection_duration_seconds histogram\n",
+		`gtss_connection_duration_seconds_bucket{le="+Inf"} 1` + "\n",
+		"gtss_connection_duration_seconds_count 1\n",
+		"gtss_accept_backoff_seconds_count 0\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestPromMetrics_Namespace(t *testing.T) {
+	m := PromMetrics{Namespace: "srv"}
+	m.TempError(5 * time.Millisecond)
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"srv_accept_temporary_errors_total 1\n",
+		`srv_accept_backoff_seconds_bucket{le="0.005"} 1` + "\n",
+		`srv_accept_backoff_seconds_bucket{le="1"} 1` + "\n",
+		"srv_accept_backoff_seconds_sum 0.005\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, buf.String())
+		}
+	}
+}
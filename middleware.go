@@ -0,0 +1,107 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// A Middleware wraps the rest of the chain. It can run code before
+// and after the next Handler, or don't call the next at all
+type Middleware func(next Handler) Handler
+
+// Use adds given middlewares to the server. The first middleware is
+// the outermost. The innermost one wraps (*Server).Handlers. The Use
+// must be called before Serve
+func (s *Server) Use(mw ...Middleware) {
+	debugf("(*Server).Use")
+	s.middlewares = append(s.middlewares, mw...)
+}
+
+// compose middlewares and handlers to one Handler
+func (s *Server) chain() (h Handler) {
+	debugf("(*Server).chain")
+	h = (*Context).Next // the handlers
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		h = s.middlewares[i](h)
+	}
+	return
+}
+
+// A PanicError is an error the chain aborted with by the Recovery
+// middleware
+type PanicError struct {
+	Value interface{} // recovered value
+	Stack []byte      // stack trace
+}
+
+// Error implements error interface
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", p.Value)
+}
+
+// Recovery returns middleware that recovers panics of the next
+// handlers and aborts the chain with *PanicError. Thus, the
+// (*Server).ErrorHandler is able to reply. Without the Recovery
+// a panic is recovered and logged by server and the connection
+// is closed
+func Recovery() Middleware {
+	debugf("Recovery")
+	return func(next Handler) Handler {
+		return func(ctx *Context) {
+			defer func() {
+				if v := recover(); v != nil {
+					ctx.AbortWithError(&PanicError{Value: v, Stack: stack()})
+				}
+			}()
+			next(ctx)
+		}
+	}
+}
+
+// Logging returns middleware that logs every served connection, its
+// duration and abort reason if any. If the l is nil, the server
+// logger is used (see (*Server).Logger and ErrorLog)
+func Logging(l *slog.Logger) Middleware {
+	debugf("Logging")
+	return func(next Handler) Handler {
+		return func(ctx *Context) {
+			var start = time.Now()
+			next(ctx)
+			var args = ctx.logAttrs("duration", time.Since(start))
+			if err := ctx.Err(); err != nil {
+				args = append(args, "error", err)
+			}
+			if l != nil {
+				l.Info("connection served", args...)
+			} else {
+				ctx.srv.log(slog.LevelInfo, "connection served", args...)
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+type syncBuffer struct {
+	mu sync.Mutex
+	bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Buffer.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Buffer.String()
+}
+
+func TestServer_Use(t *testing.T) {
+	var (
+		order []string
+		logs  syncBuffer
+		errc  = make(chan error, 1)
+	)
+	g, ln := graceServe(t, func() *Server {
+		s := &Server{
+			Addr:            listenOn,
+			WorkersLimit:    No,
+			ReadBufferSize:  No,
+			WriteBufferSize: No,
+			Handlers: []Handler{
+				func(ctx *Context) {
+					order = append(order, "handler")
+					panic("boom")
+				},
+			},
+			ErrorHandler: func(ctx *Context, err error) {
+				errc <- err
+			},
+		}
+		s.Use(
+			Logging(slog.New(slog.NewTextHandler(&logs, nil))),
+			func(next Handler) Handler {
+				return func(ctx *Context) {
+					order = append(order, "before")
+					next(ctx)
+					order = append(order, "after")
+				}
+			},
+			Recovery(),
+		)
+		return s
+	})
+	defer g.Close()
+	conn, err := open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case err := <-errc:
+		pe, ok := err.(*PanicError)
+		if !ok {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if pe.Value != "boom" || len(pe.Stack) == 0 {
+			t.Errorf("wrong PanicError: %v; %s", pe.Value, pe.Stack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ErrorHandler is not called")
+	}
+	if got := strings.Join(order, " "); got != "before handler after" {
+		t.Errorf("wrong order: %s", got)
+	}
+	if !strings.Contains(logs.String(), "connection served") {
+		t.Errorf("missing log record: %q", logs.String())
+	}
+}
+
+func TestServer_chain(t *testing.T) {
+	var s Server
+	var called bool
+	s.Use(func(next Handler) Handler {
+		return func(ctx *Context) {
+			ctx.Abort()
+			next(ctx)
+		}
+	})
+	s.Handlers = []Handler{func(*Context) { called = true }}
+	ctx := s.createContext(context.Background(), dummyConn{}, No, No)
+	ctx.handlers, ctx.index = s.Handlers, -1
+	s.chain()(ctx)
+	if called {
+		t.Error("aborted by middleware chain is continued")
+	}
+}
+
+type dummyConn struct{ net.Conn }
+
+func (dummyConn) RemoteAddr() net.Addr { return nil }
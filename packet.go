@@ -0,0 +1,418 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// internal defaults of packet server
+const (
+	defaultPacketNet       = "udp"
+	defaultMaxPacketSize   = 64 * 1024
+	defaultPacketQueueSize = 1024
+)
+
+// A PacketContext represents received packet
+type PacketContext struct {
+	// Payload of the packet. It's valid until the last handler returns
+	Payload []byte
+	// Addr is source address of the packet
+	Addr net.Addr
+
+	pc      net.PacketConn
+	buf     *[]byte // pooled buffer of the Payload
+	kv      map[interface{}]interface{}
+	aborted bool
+}
+
+// Write sends reply to source of the packet
+func (p *PacketContext) Write(b []byte) (n int, err error) {
+	return p.pc.WriteTo(b, p.Addr)
+}
+
+// LocalAddr returns address of the server the packet received on
+func (p *PacketContext) LocalAddr() net.Addr {
+	debugf("(*PacketContext).LocalAddr")
+	return p.pc.LocalAddr()
+}
+
+// Connection returns underlying net.PacketConn
+func (p *PacketContext) Connection() net.PacketConn {
+	debugf("(*PacketContext).Connection")
+	return p.pc
+}
+
+// Abort prevents pending handlers from being called
+func (p *PacketContext) Abort() {
+	debugf("(*PacketContext).Abort: %v", p.Addr)
+	p.aborted = true
+}
+
+// IsAborted returns true if the chain is aborted
+func (p *PacketContext) IsAborted() bool {
+	debugf("(*PacketContext).IsAborted: %v", p.Addr)
+	return p.aborted
+}
+
+// Set any value associated with given key. The value is alive
+// while the packet is handled. The provided key must be comparable
+func (p *PacketContext) Set(key, value interface{}) {
+	debugf("(*PacketContext).Set: %v; %v=%v", p.Addr, key, value)
+	if p.kv == nil {
+		p.kv = make(map[interface{}]interface{})
+	}
+	p.kv[key] = value
+}
+
+// Get return stored value by given key. The provided key must be
+// comparable
+func (p *PacketContext) Get(key interface{}) interface{} {
+	debugf("(*PacketContext).Get: %v; %v", p.Addr, key)
+	return p.kv[key]
+}
+
+// Del deletes stored value by given key. The provided key must be
+// comparable
+func (p *PacketContext) Del(key interface{}) {
+	debugf("(*PacketContext).Del: %v; %v", p.Addr, key)
+	delete(p.kv, key)
+}
+
+// reset context to store it inside pool
+func (p *PacketContext) reset() {
+	debugf("(*PacketContext).reset")
+	p.Payload, p.Addr, p.pc, p.buf = nil, nil, nil, nil
+	p.kv, p.aborted = nil, false
+}
+
+// A PacketHandler implements a packet handler. Like the Handler,
+// it's possible to use many handlers one by one
+type PacketHandler func(ctx *PacketContext)
+
+// A PacketServer implements UDP (or unixgram) server
+type PacketServer struct {
+	// Net is "udp", "udp4", "udp6" or "unixgram", defaults to "udp"
+	Net string
+	// Addr is address to listen on, "0.0.0.0:3000" if empty
+	Addr string
+	// Handlers are successive handlers to invoke for every packet
+	Handlers []PacketHandler
+	// Workers is number of goroutines handling packets. Use Default
+	// for number of CPUs. Use No to handle every packet in separate
+	// goroutine
+	Workers int
+	// QueueSize is maximum number of received packets waiting for a
+	// worker, if the queue is full, the reading is blocked. Use
+	// Default for 1024 or No for unbuffered queue
+	QueueSize int
+	// MaxPacketSize is size of read buffers, 64KiB if zero. Longer
+	// packets are truncated
+	MaxPacketSize int
+	// Logger is optional structured logger, see (*Server).Logger
+	Logger *slog.Logger
+	// ErrorLog is used if the Logger is nil, see (*Server).ErrorLog
+	ErrorLog *log.Logger
+
+	ctxPool sync.Pool // *PacketContext
+	bufPool sync.Pool // *[]byte
+
+	active   int64      // packets in handlers, atomic
+	mu       sync.Mutex // guards the idle and the stopping
+	idle     idleSignal // no packets in handlers
+	stopping map[net.PacketConn]struct{}
+}
+
+// log with given level, message and key-value pairs
+func (s *PacketServer) log(level slog.Level, msg string,
+	args ...interface{}) {
+
+	debugf("(*PacketServer).log: %s", msg)
+	logTo(s.Logger, s.ErrorLog, level, msg, args...)
+}
+
+// check and get workers, queue size and max packet size
+func (s *PacketServer) params() (workers, queue, size int, err error) {
+	debugf("(*PacketServer).params")
+	switch workers = s.Workers; {
+	case workers == Default:
+		workers = runtime.NumCPU()
+	case workers < No:
+		err = fmt.Errorf("negative (*PacketServer).Workers: %d", s.Workers)
+		return
+	}
+	switch queue = s.QueueSize; {
+	case queue == Default:
+		queue = defaultPacketQueueSize
+	case queue == No:
+		queue = 0
+	case queue < No:
+		err = fmt.Errorf("negative (*PacketServer).QueueSize: %d",
+			s.QueueSize)
+		return
+	}
+	switch size = s.MaxPacketSize; {
+	case size == 0:
+		size = defaultMaxPacketSize
+	case size < 0:
+		err = fmt.Errorf("negative (*PacketServer).MaxPacketSize: %d",
+			s.MaxPacketSize)
+	}
+	return
+}
+
+func (s *PacketServer) listen() (pc net.PacketConn, err error) {
+	debugf("(*PacketServer).listen")
+	n, a := s.Net, s.Addr
+	if n == "" {
+		n = defaultPacketNet
+	}
+	if a == "" {
+		a = defaultAddr
+	}
+	return net.ListenPacket(n, a)
+}
+
+// ListenAndServe listens on the (*PacketServer).Net and Addr and then
+// calls Serve. ListenAndServe always returns a non-nil error
+func (s *PacketServer) ListenAndServe() error {
+	debugf("(*PacketServer).ListenAndServe")
+	pc, err := s.listen()
+	if err != nil {
+		return err
+	}
+	return s.Serve(pc)
+}
+
+// get buffer from pool or create new one
+func (s *PacketServer) getBuffer(size int) *[]byte {
+	if ifc := s.bufPool.Get(); ifc != nil {
+		if buf := ifc.(*[]byte); len(*buf) == size {
+			return buf
+		}
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+// get context from pool or create new one
+func (s *PacketServer) getContext() *PacketContext {
+	if ifc := s.ctxPool.Get(); ifc != nil {
+		return ifc.(*PacketContext)
+	}
+	return new(PacketContext)
+}
+
+// Serve reads packets from the pc and handles them by the Handlers
+// using workers pool. Serve closes the pc after all. When the pc is
+// closed or stopped by (*Grace).Close, queued packets are handled
+// before the Serve returns, and their handlers still can reply. Serve
+// always returns a non-nil error
+func (s *PacketServer) Serve(pc net.PacketConn) (err error) {
+	debugf("(*PacketServer).Serve")
+	defer pc.Close()
+	defer s.unstop(pc)
+	var workers, queue, size int
+	if workers, queue, size, err = s.params(); err != nil {
+		return
+	}
+	var (
+		packets = make(chan *PacketContext, queue)
+		wg      sync.WaitGroup
+	)
+	defer wg.Wait()      // then close the pc
+	defer close(packets) // workers handle queued packets and exit
+	if workers != No {
+		wg.Add(workers)
+		for i := 0; i < workers; i++ {
+			go func() {
+				defer wg.Done()
+				for ctx := range packets {
+					s.serve(ctx)
+				}
+			}()
+		}
+	}
+	var tempDelay time.Duration
+	for {
+		var buf = s.getBuffer(size)
+		n, addr, e := pc.ReadFrom(*buf)
+		if e != nil {
+			s.bufPool.Put(buf)
+			if s.stopped(pc) {
+				return net.ErrClosed
+			}
+			if errors.Is(e, net.ErrClosed) {
+				return e
+			}
+			if ne, ok := e.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = minTempDelay
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > maxTempDelay {
+					tempDelay = maxTempDelay
+				}
+				s.log(slog.LevelWarn, "read error", "error", e,
+					"backoff", tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
+			return e
+		}
+		tempDelay = 0
+		ctx := s.getContext()
+		ctx.Payload, ctx.Addr, ctx.pc, ctx.buf = (*buf)[:n], addr, pc, buf
+		atomic.AddInt64(&s.active, 1)
+		if workers == No {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.serve(ctx)
+			}()
+		} else {
+			packets <- ctx
+		}
+	}
+}
+
+// handle a packet
+func (s *PacketServer) serve(ctx *PacketContext) {
+	debugf("(*PacketServer).serve")
+	defer func() {
+		if err := recover(); err != nil {
+			s.log(slog.LevelError, "panic serving", "remote_addr",
+				ctx.Addr.String(), "error", err, "stack", stack())
+		}
+		s.bufPool.Put(ctx.buf)
+		ctx.reset()
+		s.ctxPool.Put(ctx)
+		if atomic.AddInt64(&s.active, -1) == 0 {
+			s.mu.Lock()
+			if s.activeCount() == 0 {
+				s.idle.notify()
+			}
+			s.mu.Unlock()
+		}
+	}()
+	for _, h := range s.Handlers {
+		if ctx.aborted {
+			return
+		}
+		h(ctx)
+	}
+}
+
+// number of packets in handlers or waiting for a worker
+func (s *PacketServer) activeCount() int {
+	debugf("(*PacketServer).activeCount")
+	return int(atomic.LoadInt64(&s.active))
+}
+
+// closed when there are no packets in handlers
+func (s *PacketServer) drained() <-chan struct{} {
+	debugf("(*PacketServer).drained")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.idle.wait(s.activeCount())
+}
+
+// packets can't be killed, it returns number of abandoned
+func (s *PacketServer) closeActive() int {
+	debugf("(*PacketServer).closeActive")
+	return s.activeCount()
+}
+
+// stop reading from the pc, the pc is kept open for replies until the
+// Serve returns
+func (s *PacketServer) stop(pc net.PacketConn) {
+	debugf("(*PacketServer).stop")
+	s.mu.Lock()
+	if s.stopping == nil {
+		s.stopping = make(map[net.PacketConn]struct{})
+	}
+	s.stopping[pc] = struct{}{}
+	s.mu.Unlock()
+	if pc.SetReadDeadline(time.Unix(1, 0)) != nil {
+		pc.Close() // can't wake the ReadFrom up
+	}
+}
+
+// is reading from the pc stopped
+func (s *PacketServer) stopped(pc net.PacketConn) (ok bool) {
+	s.mu.Lock()
+	_, ok = s.stopping[pc]
+	s.mu.Unlock()
+	return
+}
+
+// forget stopped pc
+func (s *PacketServer) unstop(pc net.PacketConn) {
+	s.mu.Lock()
+	delete(s.stopping, pc)
+	s.mu.Unlock()
+}
+
+// ListenAndServePacket in separate gorotine. It panics if 's' is nil
+func (g *Grace) ListenAndServePacket(s *PacketServer) {
+	debugf("(*Grace).ListenAndServePacket")
+	pc, err := s.listen()
+	if err != nil {
+		g.fail(err)
+		return
+	}
+	g.ServePacket(s, pc)
+}
+
+// ServePacket in separate gorotine. It panics if 's' is nil. The
+// Close stops reading, but queued packets are handled and can be
+// replied. The Shutdown waits for queued packets, but they can't be
+// killed, thus killed are abandoned packets
+func (g *Grace) ServePacket(s *PacketServer, pc net.PacketConn) {
+	debugf("(*Grace).ServePacket")
+	g.prepare()
+	g.s, g.ls = nil, nil
+	g.pc, g.ps, g.d = pc, s, s
+	go func() {
+		err := s.Serve(pc)
+		debugf("(*Grace).ServePacket: (*PacketServer).Serve returns")
+		select {
+		case <-g.closed:
+		default:
+			g.err = err
+		}
+		close(g.done)
+	}()
+}
@@ -0,0 +1,196 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func packetServe(t *testing.T, s *PacketServer) (g *Grace, pc net.PacketConn) {
+	var err error
+	if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	g = new(Grace)
+	g.ServePacket(s, pc)
+	return
+}
+
+func packetExchange(t *testing.T, addr net.Addr, msg []byte) []byte {
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var buf = make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+func TestPacketServer_Serve(t *testing.T) {
+	for _, workers := range []int{Default, No} {
+		s := &PacketServer{
+			Workers: workers,
+			Handlers: []PacketHandler{
+				func(ctx *PacketContext) {
+					ctx.Set("upper", bytes.ToUpper(ctx.Payload))
+				},
+				func(ctx *PacketContext) {
+					if string(ctx.Payload) == "abort" {
+						ctx.Write([]byte("aborted"))
+						ctx.Abort()
+					}
+				},
+				func(ctx *PacketContext) {
+					ctx.Write(ctx.Get("upper").([]byte))
+				},
+			},
+			ErrorLog: discardLogger(),
+		}
+		g, pc := packetServe(t, s)
+		for _, msg := range []string{"hello", "world"} {
+			if got := packetExchange(t, pc.LocalAddr(), []byte(msg)); string(got) !=
+				string(bytes.ToUpper([]byte(msg))) {
+				t.Errorf("workers %d: wrong reply %q", workers, got)
+			}
+		}
+		if got := packetExchange(t, pc.LocalAddr(), []byte("abort")); string(got) != "aborted" {
+			t.Errorf("workers %d: wrong reply %q", workers, got)
+		}
+		g.Close()
+		if err := g.Err(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPacketServer_params(t *testing.T) {
+	for _, s := range []*PacketServer{
+		{Workers: -2},
+		{QueueSize: -2},
+		{MaxPacketSize: -1},
+	} {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Serve(pc); err == nil {
+			t.Errorf("missing error for %+v", s)
+		}
+	}
+}
+
+func TestPacketServer_panic(t *testing.T) {
+	var buf syncBuffer
+	s := &PacketServer{
+		Handlers: []PacketHandler{
+			func(ctx *PacketContext) {
+				if string(ctx.Payload) == "panic" {
+					panic("boom")
+				}
+				ctx.Write(ctx.Payload)
+			},
+		},
+		ErrorLog: log.New(&buf, "", 0),
+	}
+	g, pc := packetServe(t, s)
+	defer g.Close()
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("panic"))
+	conn.Close()
+	if got := packetExchange(t, pc.LocalAddr(), []byte("ok")); string(got) != "ok" {
+		t.Errorf("wrong reply %q", got)
+	}
+	if !strings.Contains(buf.String(), "boom") {
+		t.Errorf("panic is not logged: %q", buf.String())
+	}
+}
+
+func TestGrace_ServePacketShutdown(t *testing.T) {
+	var (
+		started  = make(chan struct{}, 1)
+		replied  = make(chan error, 1)
+		finished int32
+	)
+	s := &PacketServer{
+		Handlers: []PacketHandler{
+			func(ctx *PacketContext) {
+				started <- struct{}{}
+				time.Sleep(100 * time.Millisecond)
+				_, err := ctx.Write(ctx.Payload) // after the Close
+				replied <- err
+				atomic.StoreInt32(&finished, 1)
+			},
+		},
+		ErrorLog: discardLogger(),
+	}
+	g, pc := packetServe(t, s)
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("slow"))
+	<-started
+	if err = g.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Error("shutdown returns before the handler")
+	}
+	if drained, killed := g.ShutdownStat(); drained != 1 || killed != 0 {
+		t.Errorf("wrong shutdown stat: %d, %d", drained, killed)
+	}
+	if err = <-replied; err != nil {
+		t.Error("reply error:", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply := make([]byte, 16)
+	if n, err := conn.Read(reply); err != nil || string(reply[:n]) != "slow" {
+		t.Errorf("unexpected reply: %q, %v", reply[:n], err)
+	}
+	if _, err = pc.WriteTo(nil, conn.LocalAddr()); err == nil {
+		t.Error("the pc is not closed")
+	}
+}
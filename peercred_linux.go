@@ -0,0 +1,57 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+//go:build linux
+
+package gtss
+
+import (
+	"net"
+	"syscall"
+)
+
+func peerCred(uc *net.UnixConn) (pc *PeerCred, err error) {
+	debugf("peerCred")
+	var rc syscall.RawConn
+	if rc, err = uc.SyscallConn(); err != nil {
+		return
+	}
+	var (
+		cred *syscall.Ucred
+		cerr error
+	)
+	err = rc.Control(func(fd uintptr) {
+		cred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET,
+			syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return
+	}
+	if cerr != nil {
+		return nil, cerr
+	}
+	return &PeerCred{PID: int(cred.Pid), UID: int(cred.Uid),
+		GID: int(cred.Gid)}, nil
+}
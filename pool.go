@@ -0,0 +1,249 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// ErrNoPool is returned by (*Server).ResizePool if the server doesn't
+// serve in worker pool mode
+var ErrNoPool = errors.New("worker pool is not running")
+
+// A PoolPolicy is what to do with accepted connection if queue of
+// worker pool is full
+type PoolPolicy int
+
+// worker pool policies
+const (
+	PoolWait   PoolPolicy = iota // wait for room in the queue
+	PoolReject                   // reject with the (*Server).RejectBanner
+	PoolDrop                     // close silently
+)
+
+var poolPolicies = [...]string{
+	PoolWait:   "wait",
+	PoolReject: "reject",
+	PoolDrop:   "drop",
+}
+
+// String implements fmt.Stringer interface
+func (p PoolPolicy) String() string {
+	if p >= 0 && int(p) < len(poolPolicies) {
+		return poolPolicies[p]
+	}
+	return "PoolPolicy(" + fmt.Sprint(int(p)) + ")"
+}
+
+// a poolTask is accepted connection waiting for a worker
+type poolTask struct {
+	ctx    *Context
+	chain  Handler
+	queued time.Time
+}
+
+// a workerPool is queue and workers shared between all listeners of
+// a server; it's guarded by mutex of the server
+type workerPool struct {
+	queue   chan poolTask
+	stops   []chan struct{} // one per worker
+	serving int             // number of Serve calls using the pool
+}
+
+// check pool options, it returns zero workers if the pool mode is off
+func (s *Server) poolOptions() (workers, queue int, err error) {
+	debugf("(*Server).poolOptions")
+	switch workers = s.PoolWorkers; {
+	case workers == Default, workers == No:
+		return 0, 0, nil // off
+	case workers < No:
+		err = fmt.Errorf("negative (*Server).PoolWorkers: %d",
+			s.PoolWorkers)
+		return
+	}
+	switch queue = s.PoolQueueSize; {
+	case queue == Default:
+		queue = workers
+	case queue == No:
+		queue = 0
+	case queue < No:
+		err = fmt.Errorf("negative (*Server).PoolQueueSize: %d",
+			s.PoolQueueSize)
+		return
+	}
+	if s.PoolPolicy < PoolWait || s.PoolPolicy > PoolDrop {
+		err = fmt.Errorf("unknown (*Server).PoolPolicy: %v", s.PoolPolicy)
+	}
+	return
+}
+
+// start the pool or join already started one
+func (s *Server) startPool(workers, queue int) (p *workerPool) {
+	debugf("(*Server).startPool: %d, %d", workers, queue)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p = s.pool; p == nil {
+		p = &workerPool{queue: make(chan poolTask, queue)}
+		s.pool = p
+		s.resizePool(p, workers)
+	}
+	p.serving++
+	return
+}
+
+// leave the pool, the last Serve stops it; the workers serve queued
+// connections and exit
+func (s *Server) stopPool(p *workerPool) {
+	debugf("(*Server).stopPool")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p.serving--; p.serving == 0 {
+		close(p.queue)
+		s.pool, p.stops = nil, nil
+	}
+}
+
+// resize the pool, it must be called under the lock
+func (s *Server) resizePool(p *workerPool, workers int) {
+	debugf("(*Server).resizePool: %d", workers)
+	for len(p.stops) < workers {
+		stop := make(chan struct{})
+		p.stops = append(p.stops, stop)
+		go s.poolWorker(p, stop)
+	}
+	for len(p.stops) > workers {
+		last := len(p.stops) - 1
+		close(p.stops[last]) // exits after current connection
+		p.stops = p.stops[:last]
+	}
+	s.limit = workers
+	s.poolMetrics(len(p.queue), workers)
+}
+
+// ResizePool changes number of workers of running worker pool. Extra
+// workers exit after their current connections. It returns ErrNoPool
+// if the server doesn't serve in worker pool mode
+func (s *Server) ResizePool(workers int) error {
+	debugf("(*Server).ResizePool: %d", workers)
+	if workers < 1 {
+		return fmt.Errorf("invalid number of workers: %d", workers)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pool == nil {
+		return ErrNoPool
+	}
+	s.resizePool(s.pool, workers)
+	return nil
+}
+
+// PoolStat returns number of workers and number of connections
+// waiting for a worker. It returns zeros if the server doesn't
+// serve in worker pool mode
+func (s *Server) PoolStat() (workers, queued int) {
+	debugf("(*Server).PoolStat")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pool == nil {
+		return
+	}
+	return len(s.pool.stops), len(s.pool.queue)
+}
+
+// report queue depth if the Metrics implements PoolMetrics
+func (s *Server) poolMetrics(depth, workers int) {
+	if pm, ok := s.Metrics.(PoolMetrics); ok {
+		pm.Queue(depth, workers)
+	}
+}
+
+// a worker serves queued connections until it's stopped or the
+// queue is closed
+func (s *Server) poolWorker(p *workerPool, stop chan struct{}) {
+	debugf("(*Server).poolWorker")
+	for {
+		select {
+		case <-stop:
+			return
+		case t, ok := <-p.queue:
+			if !ok {
+				return
+			}
+			if pm, ok := s.Metrics.(PoolMetrics); ok {
+				pm.Waited(time.Since(t.queued))
+				s.mu.Lock()
+				pm.Queue(len(p.queue), len(p.stops))
+				s.mu.Unlock()
+			}
+			s.serve(t.ctx, t.chain)
+		}
+	}
+}
+
+// enqueue accepted connection according to the (*Server).PoolPolicy;
+// if the queue is full and the connection can't wait, it's rejected
+func (s *Server) enqueue(p *workerPool, ctx *Context, chain Handler) {
+	debugf("(*Server).enqueue")
+	var t = poolTask{ctx: ctx, chain: chain, queued: time.Now()}
+	if s.PoolPolicy == PoolWait {
+		p.queue <- t
+	} else {
+		select {
+		case p.queue <- t:
+		default:
+			s.unqueue(ctx)
+			return
+		}
+	}
+	if pm, ok := s.Metrics.(PoolMetrics); ok {
+		s.mu.Lock()
+		pm.Queue(len(p.queue), len(p.stops))
+		s.mu.Unlock()
+	}
+}
+
+// reject or drop connection that doesn't fit the queue
+func (s *Server) unqueue(ctx *Context) {
+	debugf("(*Server).unqueue")
+	var conn = ctx.Conn
+	ctx.cancel()
+	s.trackContext(ctx, false)
+	s.release(ctx.ipKey, ctx.netKey)
+	s.setState(ctx, StateClosed)
+	s.putContext(ctx)
+	if s.PoolPolicy == PoolReject {
+		s.reject(conn, "worker pool queue is full")
+		return
+	}
+	s.metrics().Rejected()
+	conn.Close()
+	s.log(slog.LevelDebug, "connection dropped",
+		"remote_addr", conn.RemoteAddr().String(),
+		"reason", "worker pool queue is full")
+}
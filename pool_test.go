@@ -0,0 +1,236 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// a blocking handler: it signals when started and waits for release
+func hBlock(started chan<- struct{}, release <-chan struct{}) Handler {
+	return func(ctx *Context) {
+		started <- struct{}{}
+		<-release
+		ctx.Write([]byte("ok"))
+	}
+}
+
+// wait until the server has given number of queued connections
+func waitQueued(t *testing.T, s *Server, want int) {
+	for i := 0; i < 200; i++ {
+		if _, queued := s.PoolStat(); queued == want {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	_, queued := s.PoolStat()
+	t.Fatalf("queued %d connections, want %d", queued, want)
+}
+
+func dialPool(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	return conn
+}
+
+func readAll(t *testing.T, conn net.Conn) string {
+	defer conn.Close()
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Error(err)
+	}
+	return string(b)
+}
+
+func TestServer_PoolWorkers(t *testing.T) {
+	var (
+		started = make(chan struct{}, 4)
+		release = make(chan struct{})
+		m       PromMetrics
+		g       Grace
+		s       = &Server{
+			PoolWorkers:   2,
+			PoolQueueSize: 10,
+			Handlers:      []Handler{hBlock(started, release)},
+			Metrics:       &m,
+			ErrorLog:      discardLogger(),
+		}
+	)
+	g.ServeAll(s, mustListen(t, "tcp", "127.0.0.1:0"))
+	addr := g.ls[0].Addr().String()
+	var conns []net.Conn
+	for i := 0; i < 4; i++ {
+		conns = append(conns, dialPool(t, addr))
+	}
+	<-started
+	<-started
+	waitQueued(t, s, 2)
+	if workers, _ := s.PoolStat(); workers != 2 {
+		t.Errorf("wrong number of workers: %d", workers)
+	}
+	if n := s.activeCount(); n != 4 {
+		t.Errorf("wrong number of active connections: %d", n)
+	}
+	if depth := atomic.LoadInt64(&m.depth); depth != 2 {
+		t.Errorf("wrong queue depth metric: %d", depth)
+	}
+	close(release)
+	// the Shutdown waits for queued connections
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := g.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range conns {
+		if reply := readAll(t, conn); reply != "ok" {
+			t.Errorf("unexpected reply: %q", reply)
+		}
+	}
+	if workers, queued := s.PoolStat(); workers != 0 || queued != 0 {
+		t.Errorf("pool is not stopped: %d, %d", workers, queued)
+	}
+	m.wait.mu.Lock()
+	if m.wait.count != 4 {
+		t.Errorf("wrong number of wait observations: %d", m.wait.count)
+	}
+	m.wait.mu.Unlock()
+}
+
+func TestServer_PoolPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy PoolPolicy
+		reply  string
+	}{
+		{PoolReject, "busy\n"},
+		{PoolDrop, ""},
+	} {
+		var (
+			started = make(chan struct{}, 3)
+			release = make(chan struct{})
+			m       PromMetrics
+			g       Grace
+			s       = &Server{
+				PoolWorkers:   1,
+				PoolQueueSize: 1,
+				PoolPolicy:    tt.policy,
+				RejectBanner:  []byte("busy\n"),
+				Handlers:      []Handler{hBlock(started, release)},
+				Metrics:       &m,
+				ErrorLog:      discardLogger(),
+			}
+		)
+		g.ServeAll(s, mustListen(t, "tcp", "127.0.0.1:0"))
+		addr := g.ls[0].Addr().String()
+		first := dialPool(t, addr)
+		<-started
+		second := dialPool(t, addr)
+		waitQueued(t, s, 1)
+		if reply := readAll(t, dialPool(t, addr)); reply != tt.reply {
+			t.Errorf("%s: unexpected reply: %q", tt.policy, reply)
+		}
+		if n := atomic.LoadUint64(&m.rejected); n != 1 {
+			t.Errorf("%s: wrong number of rejected: %d", tt.policy, n)
+		}
+		close(release)
+		for _, conn := range []net.Conn{first, second} {
+			if reply := readAll(t, conn); reply != "ok" {
+				t.Errorf("%s: unexpected reply: %q", tt.policy, reply)
+			}
+		}
+		g.Close()
+	}
+}
+
+func TestServer_ResizePool(t *testing.T) {
+	var (
+		started = make(chan struct{}, 3)
+		release = make(chan struct{})
+		g       Grace
+		s       = &Server{
+			PoolWorkers: 1,
+			Handlers:    []Handler{hBlock(started, release)},
+			ErrorLog:    discardLogger(),
+		}
+	)
+	if err := s.ResizePool(2); err != ErrNoPool {
+		t.Errorf("unexpected error: %v", err)
+	}
+	g.ServeAll(s, mustListen(t, "tcp", "127.0.0.1:0"))
+	defer g.Close()
+	addr := g.ls[0].Addr().String()
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conns = append(conns, dialPool(t, addr))
+	}
+	<-started
+	waitQueued(t, s, 1) // the queue size is 1, the third waits to fit
+	if err := s.ResizePool(3); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	<-started
+	if err := s.ResizePool(1); err != nil {
+		t.Fatal(err)
+	}
+	if workers, _ := s.PoolStat(); workers != 1 {
+		t.Errorf("wrong number of workers: %d", workers)
+	}
+	if err := s.ResizePool(0); err == nil {
+		t.Error("missing error")
+	}
+	close(release)
+	for _, conn := range conns {
+		if reply := readAll(t, conn); reply != "ok" {
+			t.Errorf("unexpected reply: %q", reply)
+		}
+	}
+}
+
+func TestServer_poolOptions(t *testing.T) {
+	for _, s := range []*Server{
+		{PoolWorkers: -2},
+		{PoolWorkers: 1, PoolQueueSize: -2},
+		{PoolWorkers: 1, PoolPolicy: PoolPolicy(10)},
+	} {
+		if err := s.Serve(mustListen(t, "tcp", "127.0.0.1:0")); err == nil {
+			t.Errorf("missing error: %d, %d, %v", s.PoolWorkers,
+				s.PoolQueueSize, s.PoolPolicy)
+		}
+	}
+	if got := PoolPolicy(10).String(); !strings.Contains(got, "10") {
+		t.Errorf("unexpected string: %q", got)
+	}
+}
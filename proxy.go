@@ -0,0 +1,407 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// internal defaults of PROXY protocol
+const (
+	defaultProxyHeaderTimeout time.Duration = 5 * time.Second
+
+	proxyV1MaxLen = 107 // including CRLF
+)
+
+// PROXY protocol v2 signature
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 TLV types
+const (
+	ProxyTLVALPN      byte = 0x01
+	ProxyTLVAuthority byte = 0x02
+	ProxyTLVCRC32C    byte = 0x03
+	ProxyTLVNoop      byte = 0x04
+	ProxyTLVUniqueID  byte = 0x05
+	ProxyTLVSSL       byte = 0x20
+	ProxyTLVNetNS     byte = 0x30
+
+	// sub-types of the ProxyTLVSSL
+
+	ProxyTLVSSLVersion byte = 0x21
+	ProxyTLVSSLCN      byte = 0x22
+	ProxyTLVSSLCipher  byte = 0x23
+	ProxyTLVSSLSigAlg  byte = 0x24
+	ProxyTLVSSLKeyAlg  byte = 0x25
+)
+
+// ErrProxyHeader is returned for a malformed PROXY protocol header
+var ErrProxyHeader = errors.New("invalid PROXY protocol header")
+
+// A ProxyTLV is type-length-value of PROXY protocol v2 header
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// A ProxySSL represents ProxyTLVSSL of PROXY protocol v2 header
+type ProxySSL struct {
+	Client byte       // PP2_CLIENT_* bit field
+	Verify uint32     // zero if client certificate verified
+	TLVs   []ProxyTLV // sub-TLVs, such as ProxyTLVSSLVersion
+}
+
+// Get returns value of sub-TLV by given type or nil
+func (p *ProxySSL) Get(typ byte) []byte {
+	return getTLV(p.TLVs, typ)
+}
+
+// A ProxyInfo represents parsed PROXY protocol header
+type ProxyInfo struct {
+	Version     int        // 1 or 2
+	Local       bool       // LOCAL command (v2) or UNKNOWN (v1)
+	Source      net.Addr   // real client address, nil if Local
+	Destination net.Addr   // real server address, nil if Local
+	TLVs        []ProxyTLV // v2 only
+}
+
+func getTLV(tlvs []ProxyTLV, typ byte) []byte {
+	for _, tlv := range tlvs {
+		if tlv.Type == typ {
+			return tlv.Value
+		}
+	}
+	return nil
+}
+
+// Get returns value of TLV by given type or nil
+func (p *ProxyInfo) Get(typ byte) []byte {
+	return getTLV(p.TLVs, typ)
+}
+
+// ALPN returns ProxyTLVALPN value or nil
+func (p *ProxyInfo) ALPN() []byte {
+	return p.Get(ProxyTLVALPN)
+}
+
+// Authority returns ProxyTLVAuthority value (host name
+// from SNI, usually) or empty string
+func (p *ProxyInfo) Authority() string {
+	return string(p.Get(ProxyTLVAuthority))
+}
+
+// SSL returns parsed ProxyTLVSSL or nil
+func (p *ProxyInfo) SSL() *ProxySSL {
+	var v = p.Get(ProxyTLVSSL)
+	if len(v) < 5 {
+		return nil
+	}
+	tlvs, err := parseProxyTLVs(v[5:])
+	if err != nil {
+		return nil
+	}
+	return &ProxySSL{
+		Client: v[0],
+		Verify: binary.BigEndian.Uint32(v[1:5]),
+		TLVs:   tlvs,
+	}
+}
+
+// ReadProxyHeader reads PROXY protocol v1 or v2 header from given
+// reader. It reads exactly the header, nothing more, thus it's safe
+// to read from a connection directly
+func ReadProxyHeader(r io.Reader) (p *ProxyInfo, err error) {
+	debugf("ReadProxyHeader")
+	var head [16]byte
+	if _, err = io.ReadFull(r, head[:6]); err != nil {
+		return
+	}
+	switch {
+	case string(head[:6]) == "PROXY ":
+		return readProxyV1(r, head[:6])
+	case bytes.Equal(head[:6], proxyV2Sig[:6]):
+		if _, err = io.ReadFull(r, head[6:]); err != nil {
+			return
+		}
+		return readProxyV2(r, head[:])
+	}
+	return nil, ErrProxyHeader
+}
+
+// read rest of v1 header byte by byte, because the r can be not buffered
+func readProxyV1(r io.Reader, head []byte) (p *ProxyInfo, err error) {
+	debugf("readProxyV1")
+	var line = make([]byte, len(head), proxyV1MaxLen)
+	copy(line, head)
+	for {
+		if len(line) == proxyV1MaxLen {
+			return nil, ErrProxyHeader
+		}
+		var b [1]byte
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			return
+		}
+		if line = append(line, b[0]); b[0] == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyHeader
+	}
+	var fields = strings.Split(string(line[:len(line)-2]), " ")
+	p = &ProxyInfo{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		p.Local = true
+		return
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyHeader
+	}
+	var src, dst *net.TCPAddr
+	if src, err = parseProxyV1Addr(fields[1], fields[2], fields[4]); err != nil {
+		return
+	}
+	if dst, err = parseProxyV1Addr(fields[1], fields[3], fields[5]); err != nil {
+		return
+	}
+	p.Source, p.Destination = src, dst
+	return
+}
+
+func parseProxyV1Addr(proto, host, port string) (*net.TCPAddr, error) {
+	var ip = net.ParseIP(host)
+	if ip == nil || (proto == "TCP4") != (ip.To4() != nil) {
+		return nil, ErrProxyHeader
+	}
+	pn, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(pn)}, nil
+}
+
+// read rest of v2 header, the head is 16 bytes
+func readProxyV2(r io.Reader, head []byte) (p *ProxyInfo, err error) {
+	debugf("readProxyV2")
+	if !bytes.Equal(head[:12], proxyV2Sig) || head[12]>>4 != 2 {
+		return nil, ErrProxyHeader
+	}
+	var payload = make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	p = &ProxyInfo{Version: 2}
+	switch head[12] & 0x0f {
+	case 0x0: // LOCAL
+		p.Local = true
+	case 0x1: // PROXY
+	default:
+		return nil, ErrProxyHeader
+	}
+	var (
+		family = head[13] >> 4
+		dgram  = head[13]&0x0f == 0x2
+		size   int
+	)
+	switch family {
+	case 0x0: // UNSPEC
+		p.Local = true
+	case 0x1: // INET
+		size = 2*net.IPv4len + 4
+	case 0x2: // INET6
+		size = 2*net.IPv6len + 4
+	case 0x3: // UNIX
+		size = 2 * 108
+	default:
+		return nil, ErrProxyHeader
+	}
+	if len(payload) < size {
+		return nil, ErrProxyHeader
+	}
+	if !p.Local {
+		p.Source, p.Destination = proxyV2Addrs(family, dgram, payload[:size])
+	}
+	if p.TLVs, err = parseProxyTLVs(payload[size:]); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func proxyV2Addrs(family byte, dgram bool, b []byte) (src, dst net.Addr) {
+	if family == 0x3 { // UNIX
+		var network = "unix"
+		if dgram {
+			network = "unixgram"
+		}
+		src = &net.UnixAddr{Name: string(bytes.TrimRight(b[:108], "\x00")),
+			Net: network}
+		dst = &net.UnixAddr{Name: string(bytes.TrimRight(b[108:], "\x00")),
+			Net: network}
+		return
+	}
+	var n = (len(b) - 4) / 2
+	var (
+		srcIP   = net.IP(append([]byte(nil), b[:n]...))
+		dstIP   = net.IP(append([]byte(nil), b[n:2*n]...))
+		srcPort = int(binary.BigEndian.Uint16(b[2*n:]))
+		dstPort = int(binary.BigEndian.Uint16(b[2*n+2:]))
+	)
+	if dgram {
+		return &net.UDPAddr{IP: srcIP, Port: srcPort},
+			&net.UDPAddr{IP: dstIP, Port: dstPort}
+	}
+	return &net.TCPAddr{IP: srcIP, Port: srcPort},
+		&net.TCPAddr{IP: dstIP, Port: dstPort}
+}
+
+func parseProxyTLVs(b []byte) (tlvs []ProxyTLV, err error) {
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, ErrProxyHeader
+		}
+		var l = int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+l {
+			return nil, ErrProxyHeader
+		}
+		tlvs = append(tlvs, ProxyTLV{Type: b[0], Value: b[3 : 3+l]})
+		b = b[3+l:]
+	}
+	return
+}
+
+// initialize trusted sources of PROXY protocol headers
+func (s *Server) initProxy() (err error) {
+	debugf("(*Server).initProxy")
+	if !s.ProxyProtocol {
+		return
+	}
+	if len(s.ProxyTrustedCIDRs) == 0 {
+		return errors.New("empty (*Server).ProxyTrustedCIDRs, use " +
+			`"0.0.0.0/0" and "::/0" to trust all sources`)
+	}
+	var trusted []*net.IPNet
+	if trusted, err = parseCIDRs(s.ProxyTrustedCIDRs); err != nil {
+		return fmt.Errorf("(*Server).ProxyTrustedCIDRs: %v", err)
+	}
+	s.mu.Lock()
+	s.proxyTrusted = trusted
+	s.mu.Unlock()
+	return
+}
+
+// is given address a trusted source of PROXY headers
+func (s *Server) proxyTrustedAddr(addr net.Addr) bool {
+	debugf("(*Server).proxyTrustedAddr: %v", addr)
+	s.mu.Lock()
+	var trusted = s.proxyTrusted
+	s.mu.Unlock()
+	var ip = addrIP(addr)
+	return ip != nil && containsIP(trusted, ip)
+}
+
+// read PROXY header of the connection if need
+func (s *Server) readProxy(ctx *Context) (err error) {
+	debugf("(*Server).readProxy")
+	if !s.ProxyProtocol || !s.proxyTrustedAddr(ctx.Conn.RemoteAddr()) {
+		return
+	}
+	var timeout = s.ProxyHeaderTimeout
+	if timeout == 0 {
+		timeout = defaultProxyHeaderTimeout
+	}
+	if err = ctx.Conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+	var p *ProxyInfo
+	if p, err = ReadProxyHeader(proxyReader(ctx)); err != nil {
+		return
+	}
+	if err = ctx.Conn.SetReadDeadline(time.Time{}); err != nil {
+		return
+	}
+	s.mu.Lock() // introspection reads the address
+	ctx.proxy = p
+	s.mu.Unlock()
+	return
+}
+
+// reader of PROXY header; the header is sent before TLS handshake,
+// thus for TLS connection it's read from connection under the TLS
+func proxyReader(ctx *Context) io.Reader {
+	for conn := ctx.Conn; ; {
+		if tc, ok := conn.(*tls.Conn); ok {
+			return tc.NetConn()
+		}
+		nc, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return ctx.in
+		}
+		conn = nc.NetConn()
+	}
+}
+
+// reject connection with invalid PROXY header
+func (s *Server) rejectProxy(ctx *Context, err error) {
+	debugf("(*Server).rejectProxy")
+	s.log(slog.LevelWarn, "connection rejected",
+		ctx.logAttrs("reason", "invalid PROXY header", "error", err)...)
+	s.metrics().Rejected()
+}
+
+// Proxy returns parsed PROXY protocol header of the connection
+// or nil
+func (c *Context) Proxy() *ProxyInfo {
+	debugf("(*Context).Proxy")
+	return c.proxy
+}
+
+// RemoteAddr returns remote address of the connection. It's real
+// client address if the connection has PROXY protocol header
+func (c *Context) RemoteAddr() net.Addr {
+	if c.proxy != nil && c.proxy.Source != nil {
+		return c.proxy.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns local address of the connection. It's real
+// server address if the connection has PROXY protocol header
+func (c *Context) LocalAddr() net.Addr {
+	if c.proxy != nil && c.proxy.Destination != nil {
+		return c.proxy.Destination
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,247 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+func TestReadProxyHeader_v1(t *testing.T) {
+	const tail = "data"
+	r := strings.NewReader("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n" + tail)
+	p, err := ReadProxyHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Version != 1 || p.Local {
+		t.Errorf("wrong header: %+v", p)
+	}
+	if p.Source.String() != "1.2.3.4:1111" ||
+		p.Destination.String() != "5.6.7.8:2222" {
+		t.Errorf("wrong addresses: %v, %v", p.Source, p.Destination)
+	}
+	if r.Len() != len(tail) {
+		t.Error("read too much")
+	}
+	if p, err = ReadProxyHeader(strings.NewReader(
+		"PROXY TCP6 ::1 ::2 1 2\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if p.Source.String() != "[::1]:1" {
+		t.Errorf("wrong source: %v", p.Source)
+	}
+	if p, err = ReadProxyHeader(strings.NewReader(
+		"PROXY UNKNOWN\r\n")); err != nil || !p.Local {
+		t.Errorf("wrong UNKNOWN: %v, %v", p, err)
+	}
+	for _, bad := range []string{
+		"HELLO WORLD\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1111\r\n",
+		"PROXY TCP4 ::1 5.6.7.8 1111 2222\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1111 99999\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\n",
+		"PROXY " + strings.Repeat("x", 200) + "\r\n",
+	} {
+		if _, err := ReadProxyHeader(strings.NewReader(bad)); err == nil {
+			t.Errorf("missing error: %q", bad)
+		}
+	}
+}
+
+func proxyV2Header(cmd, fam byte, addrs []byte, tlvs ...ProxyTLV) []byte {
+	var b bytes.Buffer
+	b.Write(proxyV2Sig)
+	b.WriteByte(0x20 | cmd)
+	b.WriteByte(fam)
+	var payload = append([]byte(nil), addrs...)
+	for _, tlv := range tlvs {
+		payload = append(payload, tlv.Type, 0, 0)
+		binary.BigEndian.PutUint16(payload[len(payload)-2:],
+			uint16(len(tlv.Value)))
+		payload = append(payload, tlv.Value...)
+	}
+	binary.Write(&b, binary.BigEndian, uint16(len(payload)))
+	b.Write(payload)
+	return b.Bytes()
+}
+
+func TestReadProxyHeader_v2(t *testing.T) {
+	addrs := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x04, 0x57, 0x08, 0xae}
+	ssl := append([]byte{0x01, 0, 0, 0, 0},
+		ProxyTLVSSLVersion, 0, 7, 'T', 'L', 'S', 'v', '1', '.', '3')
+	h := proxyV2Header(0x1, 0x11, addrs,
+		ProxyTLV{ProxyTLVALPN, []byte("h2")},
+		ProxyTLV{ProxyTLVAuthority, []byte("example.com")},
+		ProxyTLV{ProxyTLVSSL, ssl},
+	)
+	r := bytes.NewReader(append(h, "data"...))
+	p, err := ReadProxyHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() != 4 {
+		t.Error("wrong number of bytes read")
+	}
+	if p.Version != 2 || p.Local {
+		t.Errorf("wrong header: %+v", p)
+	}
+	if p.Source.String() != "1.2.3.4:1111" ||
+		p.Destination.String() != "5.6.7.8:2222" {
+		t.Errorf("wrong addresses: %v, %v", p.Source, p.Destination)
+	}
+	if string(p.ALPN()) != "h2" || p.Authority() != "example.com" {
+		t.Errorf("wrong TLVs: %q, %q", p.ALPN(), p.Authority())
+	}
+	if s := p.SSL(); s == nil || s.Client != 1 || s.Verify != 0 ||
+		string(s.Get(ProxyTLVSSLVersion)) != "TLSv1.3" {
+		t.Errorf("wrong SSL: %+v", s)
+	}
+	// LOCAL
+	if p, err = ReadProxyHeader(bytes.NewReader(
+		proxyV2Header(0x0, 0x00, nil))); err != nil || !p.Local {
+		t.Errorf("wrong LOCAL: %v, %v", p, err)
+	}
+	// INET6 over DGRAM
+	addrs = make([]byte, 36)
+	addrs[15], addrs[31], addrs[33], addrs[35] = 1, 2, 1, 2
+	if p, err = ReadProxyHeader(bytes.NewReader(
+		proxyV2Header(0x1, 0x22, addrs))); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Source.(*net.UDPAddr); !ok || p.Source.String() != "[::1]:1" {
+		t.Errorf("wrong source: %#v", p.Source)
+	}
+	// malformed
+	for _, bad := range [][]byte{
+		proxyV2Header(0x2, 0x11, addrs[:12]),      // bad command
+		proxyV2Header(0x1, 0x11, addrs[:8]),       // short
+		proxyV2Header(0x1, 0x41, addrs[:12]),      // bad family
+		proxyV2Header(0x1, 0x11, addrs[:12])[:20], // truncated
+	} {
+		if _, err := ReadProxyHeader(bytes.NewReader(bad)); err == nil {
+			t.Errorf("missing error: %q", bad)
+		}
+	}
+	bad := proxyV2Header(0x1, 0x11, append(addrs[:12], 1, 0))
+	if _, err := ReadProxyHeader(bytes.NewReader(bad)); err == nil {
+		t.Error("missing error for malformed TLV")
+	}
+}
+
+func TestServer_ProxyTrustedCIDRs(t *testing.T) {
+	s := &Server{ProxyProtocol: true}
+	if err := s.Serve(mustListen(t, "tcp", "127.0.0.1:0")); err == nil ||
+		!strings.Contains(err.Error(), "ProxyTrustedCIDRs") {
+		t.Error("missing error:", err)
+	}
+	if s.proxyTrustedAddr(&net.TCPAddr{IP: net.IPv4(1, 2, 3, 4)}) {
+		t.Error("untrusted source")
+	}
+}
+
+func TestServer_ProxyProtocolTLS(t *testing.T) {
+	addrc := make(chan net.Addr, 1)
+	var g Grace
+	g.ServeAll(&Server{
+		ProxyProtocol:     true,
+		ProxyTrustedCIDRs: []string{"0.0.0.0/0", "::/0"},
+		ErrorLog:          discardLogger(),
+		Handlers: []Handler{
+			func(ctx *Context) {
+				addrc <- ctx.RemoteAddr()
+				ctx.Write([]byte("ok"))
+			},
+		},
+	}, tls.NewListener(mustListen(t, "tcp", "127.0.0.1:0"), tlsConfig(t)))
+	defer g.Close()
+	raw, err := net.Dial("tcp", g.ls[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	// plain header before the handshake
+	raw.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n"))
+	conn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	if reply, err := io.ReadAll(conn); err != nil || string(reply) != "ok" {
+		t.Errorf("unexpected reply: %q, %v", reply, err)
+	}
+	select {
+	case addr := <-addrc:
+		if addr.String() != "1.2.3.4:1111" {
+			t.Error("wrong address:", addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler is not called")
+	}
+}
+
+func TestServer_ProxyProtocol(t *testing.T) {
+	data := []byte("Hello")
+	for _, rbs := range []int{No, Default} {
+		for _, trusted := range []string{"127.0.0.0/8", "10.0.0.0/8"} {
+			addrc := make(chan net.Addr, 1)
+			g, ln := graceServe(t, func() *Server {
+				return &Server{
+					Addr:              listenOn,
+					WorkersLimit:      No,
+					ReadBufferSize:    rbs,
+					WriteBufferSize:   No,
+					ProxyProtocol:     true,
+					ProxyTrustedCIDRs: []string{trusted},
+					Handlers: []Handler{
+						func(ctx *Context) {
+							addrc <- ctx.RemoteAddr()
+						},
+					},
+				}
+			})
+			header := "PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n"
+			if err := send(ln.Addr().String(),
+				append([]byte(header), data...)); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case addr := <-addrc:
+				isProxy := addr.String() == "1.2.3.4:1111"
+				if isProxy != (trusted == "127.0.0.0/8") {
+					t.Errorf("wrong address: %v, trusted %s", addr, trusted)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("handler is not called")
+			}
+			g.Close()
+		}
+	}
+}
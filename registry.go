@@ -0,0 +1,105 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoConn is returned by (*Server).CloseConn if there is no
+// connection with given ID
+var ErrNoConn = errors.New("no such connection")
+
+// A ConnInfo represents snapshot of a connection served
+type ConnInfo struct {
+	ID           uint64    // unique per server connection ID
+	RemoteAddr   net.Addr  // remote address
+	Accepted     time.Time // accept time
+	BytesRead    int64     // read through the Context
+	BytesWritten int64     // written through the Context
+	Handler      int       // index of running handler, -1 if not started
+	State        ConnState // current state
+}
+
+// ID returns unique per server ID of the connection
+func (c *Context) ID() uint64 {
+	debugf("(*Context).ID: %v", c.RemoteAddr())
+	return c.id
+}
+
+// Accepted returns time the connection accepted
+func (c *Context) Accepted() time.Time {
+	debugf("(*Context).Accepted: %v", c.RemoteAddr())
+	return c.accepted
+}
+
+// snapshot of the connection, must be called under
+// lock of the server
+func (c *Context) info() ConnInfo {
+	debugf("(*Context).info: %v", c.RemoteAddr())
+	return ConnInfo{
+		ID:           c.id,
+		RemoteAddr:   c.RemoteAddr(),
+		Accepted:     c.accepted,
+		BytesRead:    atomic.LoadInt64(&c.nread),
+		BytesWritten: atomic.LoadInt64(&c.nwritten),
+		Handler:      int(atomic.LoadInt32(&c.handler)),
+		State:        c.State(),
+	}
+}
+
+// Conns returns list of connections the server currently holds,
+// ordered by ID. Hijacked connections are not listed
+func (s *Server) Conns() (cs []ConnInfo) {
+	debugf("(*Server).Conns")
+	s.mu.Lock()
+	cs = make([]ConnInfo, 0, len(s.active))
+	for _, ctx := range s.active {
+		cs = append(cs, ctx.info())
+	}
+	s.mu.Unlock()
+	sort.Slice(cs, func(i, j int) bool { return cs[i].ID < cs[j].ID })
+	return
+}
+
+// CloseConn closes connection with given ID. The context.Context
+// of the connection is cancelled, and a handler gets an error on
+// next I/O call. It returns ErrNoConn if there is not such
+// connection
+func (s *Server) CloseConn(id uint64) error {
+	debugf("(*Server).CloseConn: %d", id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ctx, ok := s.active[id]
+	if !ok {
+		return ErrNoConn
+	}
+	return ctx.kill()
+}
@@ -0,0 +1,98 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"io"
+	"time"
+)
+
+func TestServer_ConnsCloseConn(t *testing.T) {
+	data := []byte("Hello")
+	done := make(chan struct{})
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    No,
+			ReadBufferSize:  No,
+			WriteBufferSize: No,
+			Handlers: []Handler{
+				hSend(data, t),
+				func(ctx *Context) {
+					defer close(done)
+					if _, err := ctx.Read(make([]byte, 1)); err == nil {
+						t.Error("missing read error")
+					}
+				},
+			},
+		}
+	})
+	defer g.Close()
+	conn, err := open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = io.ReadFull(conn, make([]byte, len(data))); err != nil {
+		t.Fatal(err)
+	}
+	var ci ConnInfo
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		cs := g.s.Conns()
+		if len(cs) != 1 {
+			t.Fatalf("wrong number of connections: %d", len(cs))
+		}
+		if ci = cs[0]; ci.Handler == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond) // the second handler is not started yet
+	}
+	if ci.ID == 0 || ci.Accepted.IsZero() || ci.RemoteAddr == nil {
+		t.Errorf("wrong ConnInfo: %+v", ci)
+	}
+	if ci.BytesWritten != int64(len(data)) || ci.BytesRead != 0 {
+		t.Errorf("wrong bytes: %+v", ci)
+	}
+	if ci.Handler != 1 {
+		t.Errorf("wrong handler index: %d", ci.Handler)
+	}
+	if err := g.s.CloseConn(ci.ID); err != nil {
+		t.Error("close error:", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler is not stopped")
+	}
+	for len(g.s.Conns()) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := g.s.CloseConn(ci.ID); err != ErrNoConn {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
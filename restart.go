@@ -0,0 +1,438 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// EnvListeners is name of environment variable used to pass listeners
+// to a child process. The value is semicolon separated list of
+// "fd=key" pairs, where the key is escaped "net:addr"
+const EnvListeners = "GTSS_LISTENERS"
+
+// EnvReady is name of environment variable used to pass a pipe to a
+// child process. The value is fd of the pipe, the child writes to it
+// when it's ready, see Ready
+const EnvReady = "GTSS_READY"
+
+// handoff holds listening sockets of the process
+var handoff struct {
+	sync.Mutex
+	once      sync.Once
+	err       error                     // loading error
+	inherited map[string][]net.Listener // from parent, not used yet
+	ls        map[string][]net.Listener // to pass to a child
+}
+
+// test hook to replace the command started by Restart
+var testHookRestartCmd func() *exec.Cmd
+
+// key of listener in the handoff
+func listenerKey(n, a string) string {
+	return n + ":" + a
+}
+
+// load listeners inherited from parent process and unset the
+// environment variable to not pass it to other child processes
+func loadInherited() {
+	debugf("loadInherited")
+	handoff.inherited = make(map[string][]net.Listener)
+	env := os.Getenv(EnvListeners)
+	if env == "" {
+		return
+	}
+	os.Unsetenv(EnvListeners)
+	for _, pair := range strings.Split(env, ";") {
+		fds, key, ok := strings.Cut(pair, "=")
+		if !ok {
+			handoff.err = fmt.Errorf("malformed %s: %q", EnvListeners, pair)
+			return
+		}
+		fd, err := strconv.Atoi(fds)
+		if err != nil || fd < 3 {
+			handoff.err = fmt.Errorf("malformed %s fd: %q", EnvListeners, fds)
+			return
+		}
+		if key, err = url.QueryUnescape(key); err != nil {
+			handoff.err = fmt.Errorf("malformed %s key: %v", EnvListeners,
+				err)
+			return
+		}
+		f := os.NewFile(uintptr(fd), key)
+		l, err := net.FileListener(f)
+		f.Close() // the l holds its own copy
+		if err != nil {
+			handoff.err = fmt.Errorf("inherited listener %s: %v", key, err)
+			return
+		}
+		handoff.inherited[key] = append(handoff.inherited[key], l)
+	}
+}
+
+// take inherited listener by network and address, it returns nil, nil
+// if there is no such listener
+func takeInherited(n, a string) (l net.Listener, err error) {
+	debugf("takeInherited: %s, %s", n, a)
+	handoff.Lock()
+	defer handoff.Unlock()
+	handoff.once.Do(loadInherited)
+	if handoff.err != nil {
+		return nil, handoff.err
+	}
+	key := listenerKey(n, a)
+	if ls := handoff.inherited[key]; len(ls) > 0 {
+		l, handoff.inherited[key] = ls[0], ls[1:]
+	}
+	return
+}
+
+// keep listener to pass it to a child process on restart, the returned
+// listener is forgotten on Close
+func keepListener(n, a string, l net.Listener) net.Listener {
+	debugf("keepListener: %s, %s", n, a)
+	handoff.Lock()
+	defer handoff.Unlock()
+	if handoff.ls == nil {
+		handoff.ls = make(map[string][]net.Listener)
+	}
+	key := listenerKey(n, a)
+	handoff.ls[key] = append(handoff.ls[key], l)
+	return &keptListener{Listener: l, key: key}
+}
+
+// forget closed listener
+func forgetListener(key string, l net.Listener) {
+	debugf("forgetListener: %s", key)
+	handoff.Lock()
+	defer handoff.Unlock()
+	var ls = handoff.ls[key]
+	for i, kept := range ls {
+		if kept == l {
+			ls = append(ls[:i], ls[i+1:]...)
+			break
+		}
+	}
+	if len(ls) == 0 {
+		delete(handoff.ls, key)
+	} else {
+		handoff.ls[key] = ls
+	}
+}
+
+// a keptListener is a listener kept in the handoff
+type keptListener struct {
+	net.Listener
+	key string
+}
+
+// Close implements net.Listener interface, the listener is not passed
+// to a child process after that
+func (k *keptListener) Close() error {
+	forgetListener(k.key, k.Listener)
+	return k.Listener.Close()
+}
+
+// SyscallConn implements syscall.Conn interface
+func (k *keptListener) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := k.Listener.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a syscall.Conn", k.Listener)
+	}
+	return sc.SyscallConn()
+}
+
+// Inherited returns true if the process has been started by the
+// Restart and has got listeners of its parent. The listeners are
+// used by the Server instead of new ones, if network and address
+// are the same
+func Inherited() bool {
+	debugf("Inherited")
+	handoff.Lock()
+	defer handoff.Unlock()
+	handoff.once.Do(loadInherited)
+	return len(handoff.inherited) > 0
+}
+
+// CloseInherited closes listeners inherited from parent process, but
+// not used by servers of the process, for example, if the address has
+// been changed. Call it after all servers started listening. It returns
+// number of closed listeners
+func CloseInherited() (n int) {
+	debugf("CloseInherited")
+	handoff.Lock()
+	defer handoff.Unlock()
+	handoff.once.Do(loadInherited)
+	for key, ls := range handoff.inherited {
+		for _, l := range ls {
+			l.Close()
+			n++
+		}
+		delete(handoff.inherited, key)
+	}
+	return
+}
+
+// InheritListeners adds all listening sockets, created by servers of
+// the process, to given command. The sockets are added to the
+// ExtraFiles and described by the EnvListeners environment variable.
+// Closed listeners are skipped. Unix sockets are not removed by
+// closing listeners after that, since a child uses them. The caller
+// should close the ExtraFiles after the cmd started. Starting the cmd
+// turns the sockets to blocking mode, then a blocked Accept can't be
+// interrupted by Close; the Restart turns them back
+func InheritListeners(cmd *exec.Cmd) (err error) {
+	debugf("InheritListeners")
+	handoff.Lock()
+	defer handoff.Unlock()
+	var keys = make([]string, 0, len(handoff.ls))
+	for key := range handoff.ls {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var (
+		pairs []string
+		files []*os.File
+	)
+	for _, key := range keys {
+		var alive []net.Listener
+		for _, l := range handoff.ls[key] {
+			fl, ok := l.(interface{ File() (*os.File, error) })
+			if !ok {
+				continue
+			}
+			var f *os.File
+			if f, err = fl.File(); err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					err = nil
+					continue // forget it
+				}
+				for _, f := range files {
+					f.Close()
+				}
+				return fmt.Errorf("inherit listener %s: %v", key, err)
+			}
+			if ul, ok := fl.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(false)
+			}
+			pairs = append(pairs,
+				strconv.Itoa(3+len(cmd.ExtraFiles)+len(files))+"="+
+					url.QueryEscape(key))
+			files = append(files, f)
+			alive = append(alive, l)
+		}
+		if len(alive) == 0 {
+			delete(handoff.ls, key)
+		} else {
+			handoff.ls[key] = alive
+		}
+	}
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	var env = cmd.Env[:0:0]
+	for _, kv := range cmd.Env {
+		if !strings.HasPrefix(kv, EnvListeners+"=") &&
+			!strings.HasPrefix(kv, EnvReady+"=") {
+
+			env = append(env, kv)
+		}
+	}
+	cmd.Env = append(env, EnvListeners+"="+strings.Join(pairs, ";"))
+	cmd.ExtraFiles = append(cmd.ExtraFiles, files...)
+	return
+}
+
+// turn kept listeners back to non-blocking mode, errors are logged
+func nonblockListeners() {
+	debugf("nonblockListeners")
+	handoff.Lock()
+	defer handoff.Unlock()
+	for key, ls := range handoff.ls {
+		for _, l := range ls {
+			if err := setNonblock(l); err != nil {
+				logTo(nil, nil, slog.LevelError, "restoring non-blocking mode",
+					"listener", key, "error", err)
+			}
+		}
+	}
+}
+
+// Ready notifies parent process that the process started by Restart
+// serves, the parent shuts down after that. Call it after all servers
+// started listening. It does nothing if the process is not started by
+// Restart or if it's called again
+func Ready() (err error) {
+	debugf("Ready")
+	env := os.Getenv(EnvReady)
+	if env == "" {
+		return
+	}
+	os.Unsetenv(EnvReady)
+	fd, err := strconv.Atoi(env)
+	if err != nil || fd < 3 {
+		return fmt.Errorf("malformed %s: %q", EnvReady, env)
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+	_, err = f.Write([]byte{1})
+	return
+}
+
+// wait for a child process to write to the ready pipe
+func waitReady(r *os.File, timeout time.Duration) (err error) {
+	debugf("waitReady: %s", timeout)
+	r.SetReadDeadline(time.Now().Add(timeout)) // not supported everywhere
+	var b [1]byte
+	switch _, err = r.Read(b[:]); {
+	case err == nil:
+	case err == io.EOF:
+		err = errors.New("child process exited before ready")
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		err = fmt.Errorf("child process is not ready in %s", timeout)
+	}
+	return
+}
+
+// Restart starts new instance of the executable of the process, with
+// the same arguments and environment, and passes listening sockets to
+// it. The child process uses the sockets instead of listening. It
+// returns the started process after the child called Ready. If the
+// child exits or isn't ready in given timeout, it's killed and error
+// is returned
+func Restart(timeout time.Duration) (p *os.Process, err error) {
+	debugf("Restart: %s", timeout)
+	var cmd *exec.Cmd
+	if testHookRestartCmd != nil {
+		cmd = testHookRestartCmd()
+	} else {
+		var exe string
+		if exe, err = os.Executable(); err != nil {
+			return
+		}
+		cmd = exec.Command(exe, os.Args[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	}
+	var extra = len(cmd.ExtraFiles)
+	if err = InheritListeners(cmd); err != nil {
+		return
+	}
+	var r, w *os.File
+	if r, w, err = os.Pipe(); err == nil {
+		defer r.Close()
+		cmd.Env = append(cmd.Env,
+			EnvReady+"="+strconv.Itoa(3+len(cmd.ExtraFiles)))
+		cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+		err = cmd.Start()
+	}
+	for _, f := range cmd.ExtraFiles[extra:] {
+		f.Close() // the child has its own copies
+	}
+	nonblockListeners()
+	if err != nil {
+		return
+	}
+	if err = waitReady(r, timeout); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return
+	}
+	return cmd.Process, nil
+}
+
+// ErrNotServing is returned by (*Grace).RestartOn called before the
+// Grace started serving
+var ErrNotServing = errors.New("not serving")
+
+// RestartOn starts goroutine that restarts the process on given
+// signals, usually syscall.SIGUSR2. After the child process is ready
+// (see Ready), the Grace shuts down with given timeout, draining its
+// connections, while the child serves new ones. The child must be ready
+// in the timeout too. Restarting errors are logged and the Grace
+// continues serving. The goroutine exits when the Grace is closed. It must be called after the Grace started serving, otherwise
+// ErrNotServing is returned
+func (g *Grace) RestartOn(timeout time.Duration, sig ...os.Signal) (
+	err error) {
+
+	debugf("(*Grace).RestartOn: %s, %v", timeout, sig)
+	if g.done == nil {
+		return ErrNotServing
+	}
+	var (
+		sigc = make(chan os.Signal, 1)
+		done = g.done
+	)
+	signal.Notify(sigc, sig...)
+	go func() {
+		defer signal.Stop(sigc)
+		for {
+			select {
+			case <-sigc:
+			case <-done:
+				return
+			}
+			p, err := Restart(timeout)
+			if err != nil {
+				g.log(slog.LevelError, "restarting", "error", err)
+				continue
+			}
+			g.log(slog.LevelInfo, "restarted", "pid", p.Pid)
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			if err = g.Shutdown(ctx); err != nil {
+				g.log(slog.LevelWarn, "shutting down after restart",
+					"error", err)
+			}
+			cancel()
+			return
+		}
+	}()
+	return
+}
+
+// log using logger of the server
+func (g *Grace) log(level slog.Level, msg string, args ...interface{}) {
+	debugf("(*Grace).log: %s", msg)
+	if g.s != nil {
+		g.s.log(level, msg, args...)
+		return
+	}
+	logTo(nil, nil, level, msg, args...)
+}
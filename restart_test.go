@@ -0,0 +1,313 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+//go:build unix
+
+package gtss
+
+import (
+	"testing"
+
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const envRestartChild = "GTSS_TEST_RESTART_CHILD"
+
+// reply with given name to every line
+func hName(name string) Handler {
+	return func(ctx *Context) {
+		br := bufio.NewReader(ctx)
+		for {
+			if _, err := br.ReadString('\n'); err != nil {
+				return
+			}
+			if _, err := io.WriteString(ctx, name+"\n"); err != nil {
+				return
+			}
+			if err := ctx.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// send a line and read reply
+func ask(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.WriteString(conn, "who?\n"); err != nil {
+		return "", err
+	}
+	return bufio.NewReader(conn).ReadString('\n')
+}
+
+// the child process, it serves until stdin closed
+func TestRestartChild(t *testing.T) {
+	switch os.Getenv(envRestartChild) {
+	case "":
+		t.Skip("not a child process")
+	case "fail":
+		os.Exit(1) // fails to start
+	}
+	if !Inherited() {
+		t.Fatal("no inherited listeners")
+	}
+	if os.Getenv(EnvListeners) != "" {
+		t.Errorf("%s is not unset", EnvListeners)
+	}
+	var g Grace
+	g.ListenAndServe(&Server{
+		Addr:     "127.0.0.1:0",
+		Handlers: []Handler{hName("child")},
+		ErrorLog: discardLogger(),
+	})
+	if n := CloseInherited(); n != 0 {
+		t.Errorf("closed %d unclaimed listeners", n)
+	}
+	if err := Ready(); err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, os.Stdin)
+	g.Close()
+	if err := g.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGrace_RestartOn(t *testing.T) {
+	if os.Getenv(envRestartChild) != "" {
+		t.Skip("child process")
+	}
+	var (
+		started = make(chan *exec.Cmd, 1)
+		stdin   io.WriteCloser
+		err     error
+	)
+	testHookRestartCmd = func() *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestRestartChild$")
+		cmd.Env = append(os.Environ(), envRestartChild+"=1")
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		var err error
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			t.Error(err)
+		}
+		started <- cmd
+		return cmd
+	}
+	defer func() { testHookRestartCmd = nil }()
+
+	var (
+		g    Grace
+		logs syncBuffer
+	)
+	g.ListenAndServe(&Server{
+		Addr:     "127.0.0.1:0",
+		Handlers: []Handler{hName("parent")},
+		Logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+	})
+	defer g.Close()
+	if err = g.Err(); err != nil {
+		t.Fatal(err)
+	}
+	addr := g.ls[0].Addr().String()
+
+	// in-flight connection of the parent
+	old, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	if who, err := ask(old); err != nil || who != "parent\n" {
+		t.Fatalf("unexpected reply: %q, %v", who, err)
+	}
+
+	if err = g.RestartOn(5*time.Second, syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+
+	var cmd *exec.Cmd
+	select {
+	case cmd = <-started:
+	case <-time.After(time.Second):
+		t.Fatal("child is not started")
+	}
+
+	// new connections are served by the child
+	var who string
+	for i := 0; i < 200 && who != "child\n"; i++ {
+		time.Sleep(10 * time.Millisecond)
+		var conn net.Conn
+		if conn, err = net.Dial("tcp", addr); err != nil {
+			continue
+		}
+		who, err = ask(conn)
+		conn.Close()
+	}
+	if who != "child\n" {
+		t.Fatalf("new connections are not served by child: %q, %v", who,
+			err)
+	}
+
+	for i := 0; i < 100 && !strings.Contains(logs.String(), "restarted"); i++ {
+		time.Sleep(10 * time.Millisecond) // wait for the cmd.Start
+	}
+	if !strings.Contains(logs.String(), "restarted") {
+		t.Fatalf("restart is not logged: %q", logs.String())
+	}
+
+	// the parent still serves the old one
+	if who, err = ask(old); err != nil || who != "parent\n" {
+		t.Errorf("unexpected reply: %q, %v", who, err)
+	}
+	old.Close()
+
+	stdin.Close()
+	if err = cmd.Wait(); err != nil {
+		t.Errorf("child process: %v", err)
+	}
+}
+
+func TestGrace_RestartOn_notReady(t *testing.T) {
+	if os.Getenv(envRestartChild) != "" {
+		t.Skip("child process")
+	}
+	testHookRestartCmd = func() *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestRestartChild$")
+		cmd.Env = append(os.Environ(), envRestartChild+"=fail")
+		return cmd
+	}
+	defer func() { testHookRestartCmd = nil }()
+
+	var (
+		g    Grace
+		logs syncBuffer
+	)
+	g.ListenAndServe(&Server{
+		Addr:     "127.0.0.1:0",
+		Handlers: []Handler{hName("parent")},
+		Logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+	})
+	defer g.Close()
+	if err := g.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.RestartOn(5*time.Second, syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGUSR2)
+	for i := 0; i < 200 && !strings.Contains(logs.String(), "restarting"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(logs.String(), "exited before ready") {
+		t.Fatalf("restart failure is not logged: %q", logs.String())
+	}
+	// the parent keeps serving
+	conn, err := net.Dial("tcp", g.ls[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if who, err := ask(conn); err != nil || who != "parent\n" {
+		t.Errorf("unexpected reply: %q, %v", who, err)
+	}
+}
+
+func Test_waitReady(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err = waitReady(r, 10*time.Millisecond); err == nil ||
+		!strings.Contains(err.Error(), "not ready") {
+
+		t.Errorf("unexpected error: %v", err)
+	}
+	w.Write([]byte{1})
+	if err = waitReady(r, time.Second); err != nil {
+		t.Error(err)
+	}
+	w.Close()
+	if err = waitReady(r, time.Second); err == nil ||
+		!strings.Contains(err.Error(), "exited") {
+
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestGrace_RestartOn_notServing(t *testing.T) {
+	var g Grace
+	if err := g.RestartOn(time.Second, syscall.SIGUSR2); err != ErrNotServing {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func Test_keepListener(t *testing.T) {
+	l := keepListener("tcp", "127.0.0.1:0", mustListen(t, "tcp", "127.0.0.1:0"))
+	key := listenerKey("tcp", "127.0.0.1:0")
+	handoff.Lock()
+	kept := len(handoff.ls[key])
+	handoff.Unlock()
+	if kept != 1 {
+		t.Fatalf("kept %d listeners", kept)
+	}
+	if _, ok := l.(syscall.Conn); !ok {
+		t.Errorf("%T is not a syscall.Conn", l)
+	}
+	l.Close()
+	handoff.Lock()
+	_, ok := handoff.ls[key]
+	handoff.Unlock()
+	if ok {
+		t.Error("closed listener is not forgotten")
+	}
+}
+
+func TestCloseInherited(t *testing.T) {
+	l := mustListen(t, "tcp", "127.0.0.1:0")
+	defer l.Close()
+	handoff.Lock()
+	handoff.once.Do(loadInherited)
+	handoff.inherited[listenerKey("tcp", "127.0.0.1:1")] = []net.Listener{l}
+	handoff.Unlock()
+	if n := CloseInherited(); n != 1 {
+		t.Errorf("closed %d listeners", n)
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if Inherited() {
+		t.Error("inherited listeners left")
+	}
+}
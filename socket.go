@@ -0,0 +1,144 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// SocketOptions are options of listening TCP sockets. They are
+// supported on Linux only, listening fails if an option is set on
+// other platforms
+type SocketOptions struct {
+	// ReusePort sets SO_REUSEPORT, that allows many sockets to listen
+	// on the same address. It's set anyway if Acceptors > 1
+	ReusePort bool
+	// Backlog is maximum length of queue of pending connections,
+	// system default (somaxconn) is used if zero
+	Backlog int
+	// DeferAccept sets TCP_DEFER_ACCEPT, a connection is accepted only
+	// when data arrives or after the timeout. It's rounded up to seconds
+	DeferAccept time.Duration
+	// FastOpen sets TCP_FASTOPEN, it's length of queue of pending TFO
+	// requests, zero to not use TFO
+	FastOpen int
+}
+
+// check the options
+func (o *SocketOptions) check() (err error) {
+	debugf("(*SocketOptions).check")
+	switch {
+	case o.Backlog < 0:
+		err = fmt.Errorf("negative (*Server).Socket.Backlog: %d", o.Backlog)
+	case o.DeferAccept < 0:
+		err = fmt.Errorf("negative (*Server).Socket.DeferAccept: %s",
+			o.DeferAccept)
+	case o.FastOpen < 0:
+		err = fmt.Errorf("negative (*Server).Socket.FastOpen: %d",
+			o.FastOpen)
+	}
+	return
+}
+
+// is the n a TCP network
+func isTCPNet(n string) bool {
+	return n == "tcp" || n == "tcp4" || n == "tcp6"
+}
+
+// number of listeners per TCP address
+func (s *Server) acceptors() (n int, err error) {
+	debugf("(*Server).acceptors")
+	switch n = s.Acceptors; {
+	case n == Default, n == No:
+		n = 1
+	case n < No:
+		err = fmt.Errorf("negative (*Server).Acceptors: %d", s.Acceptors)
+	}
+	return
+}
+
+// listen TCP applying the (*Server).Socket options
+func (s *Server) listenTCP(n, a string) (l net.Listener, err error) {
+	debugf("(*Server).listenTCP: %s, %s", n, a)
+	var o = s.Socket
+	if err = o.check(); err != nil {
+		return
+	}
+	if s.Acceptors > 1 {
+		o.ReusePort = true
+	}
+	var lc = net.ListenConfig{Control: o.control}
+	if l, err = lc.Listen(context.Background(), n, a); err != nil {
+		return
+	}
+	if o.Backlog > 0 {
+		if err = setBacklog(l, o.Backlog); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("(*Server).Socket.Backlog: %v", err)
+		}
+	}
+	return
+}
+
+// listen on given network and address; for TCP it opens
+// (*Server).Acceptors listeners with SO_REUSEPORT
+func (s *Server) listenAcceptors(n, a string) (ls []net.Listener,
+	err error) {
+
+	debugf("(*Server).listenAcceptors: %s, %s", n, a)
+	var k = 1
+	if isTCPNet(n) {
+		if k, err = s.acceptors(); err != nil {
+			return
+		}
+	}
+	for i := 0; i < k; i++ {
+		var (
+			l    net.Listener
+			bind = a
+		)
+		if i > 0 {
+			bind = ls[0].Addr().String() // the same port if it's zero
+		}
+		if l, err = s.listenBind(n, a, bind); err != nil {
+			closeListeners(ls)
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return
+}
+
+// close all given listeners
+func closeListeners(ls []net.Listener) {
+	debugf("closeListeners")
+	for _, l := range ls {
+		l.Close()
+	}
+}
@@ -0,0 +1,117 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+//go:build linux
+
+package gtss
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// not defined by the syscall package
+const (
+	soReusePort    = 0xf  // SO_REUSEPORT
+	tcpUserTimeout = 0x12 // TCP_USER_TIMEOUT
+	tcpFastOpen    = 0x17 // TCP_FASTOPEN
+)
+
+// control sets the options of a socket before bind
+func (o *SocketOptions) control(_, _ string, rc syscall.RawConn) (
+	err error) {
+
+	debugf("(*SocketOptions).control")
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if o.ReusePort {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET,
+				soReusePort, 1)
+			if serr != nil {
+				serr = &net.OpError{Op: "SO_REUSEPORT", Err: serr}
+				return
+			}
+		}
+		if o.DeferAccept > 0 {
+			secs := int((o.DeferAccept + 999999999) / 1000000000)
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP,
+				syscall.TCP_DEFER_ACCEPT, secs)
+			if serr != nil {
+				serr = &net.OpError{Op: "TCP_DEFER_ACCEPT", Err: serr}
+				return
+			}
+		}
+		if o.FastOpen > 0 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP,
+				tcpFastOpen, o.FastOpen)
+			if serr != nil {
+				serr = &net.OpError{Op: "TCP_FASTOPEN", Err: serr}
+			}
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	return
+}
+
+// setBacklog calls listen(2) again with given backlog, Linux
+// changes the backlog of a listening socket
+func setBacklog(l net.Listener, backlog int) (err error) {
+	debugf("setBacklog: %d", backlog)
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return nil // inherited or not a socket
+	}
+	var rc syscall.RawConn
+	if rc, err = sc.SyscallConn(); err != nil {
+		return
+	}
+	var lerr error
+	if err = rc.Control(func(fd uintptr) {
+		lerr = syscall.Listen(int(fd), backlog)
+	}); err == nil {
+		err = lerr
+	}
+	return
+}
+
+// setUserTimeout sets TCP_USER_TIMEOUT in milliseconds
+func setUserTimeout(tc *net.TCPConn, timeout time.Duration) (err error) {
+	debugf("setUserTimeout: %s", timeout)
+	var rc syscall.RawConn
+	if rc, err = tc.SyscallConn(); err != nil {
+		return
+	}
+	var serr error
+	if err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP,
+			tcpUserTimeout, int(timeout/time.Millisecond))
+	}); err == nil && serr != nil {
+		err = &net.OpError{Op: "TCP_USER_TIMEOUT", Err: serr}
+	}
+	return
+}
@@ -0,0 +1,57 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+//go:build !linux
+
+package gtss
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// control returns error if any option is set
+func (o *SocketOptions) control(_, _ string, _ syscall.RawConn) error {
+	debugf("(*SocketOptions).control")
+	if o.ReusePort || o.DeferAccept > 0 || o.FastOpen > 0 {
+		return errors.New("socket options are not supported on this " +
+			"platform")
+	}
+	return nil
+}
+
+// setBacklog is not supported
+func setBacklog(net.Listener, int) error {
+	debugf("setBacklog")
+	return errors.New("backlog is not supported on this platform")
+}
+
+// setUserTimeout is not supported
+func setUserTimeout(*net.TCPConn, time.Duration) error {
+	debugf("setUserTimeout")
+	return errors.New("TCP_USER_TIMEOUT is not supported on this platform")
+}
@@ -0,0 +1,118 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+//go:build linux
+
+package gtss
+
+import (
+	"testing"
+
+	"context"
+	"net"
+	"syscall"
+	"time"
+)
+
+func getsockopt(t *testing.T, c syscall.Conn, level, opt int) (val int) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serr error
+	if err = rc.Control(func(fd uintptr) {
+		val, serr = syscall.GetsockoptInt(int(fd), level, opt)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return
+}
+
+func TestServer_Acceptors(t *testing.T) {
+	var g Grace
+	g.ListenAndServe(&Server{
+		Addr:      "127.0.0.1:0",
+		Acceptors: 4,
+		Socket: SocketOptions{
+			Backlog:     128,
+			DeferAccept: 500 * time.Millisecond,
+			FastOpen:    16,
+		},
+		WorkersLimit: 2,
+		Handlers:     []Handler{hName("server")},
+		ErrorLog:     discardLogger(),
+	})
+	defer g.Close()
+	if err := g.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.ls) != 4 {
+		t.Fatalf("wrong number of listeners: %d", len(g.ls))
+	}
+	addr := g.ls[0].Addr().String()
+	for _, l := range g.ls {
+		if l.Addr().String() != addr {
+			t.Errorf("different addresses: %s, %s", l.Addr(), addr)
+		}
+		sc := l.(syscall.Conn)
+		if getsockopt(t, sc, syscall.SOL_SOCKET, soReusePort) != 1 {
+			t.Error("SO_REUSEPORT is not set")
+		}
+		if getsockopt(t, sc, syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT) == 0 {
+			t.Error("TCP_DEFER_ACCEPT is not set")
+		}
+	}
+	for i := 0; i < 20; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if who, err := ask(conn); err != nil || who != "server\n" {
+			t.Errorf("unexpected reply: %q, %v", who, err)
+		}
+		conn.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := g.Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServer_SocketOptionsErrors(t *testing.T) {
+	for _, s := range []*Server{
+		{Addr: "127.0.0.1:0", Acceptors: -2},
+		{Addr: "127.0.0.1:0", Socket: SocketOptions{Backlog: -1}},
+		{Addr: "127.0.0.1:0", Socket: SocketOptions{DeferAccept: -1}},
+		{Addr: "127.0.0.1:0", Socket: SocketOptions{FastOpen: -1}},
+	} {
+		if err := s.ListenAndServe(); err == nil {
+			t.Errorf("missing error: %+v", s.Socket)
+		}
+	}
+}
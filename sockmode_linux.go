@@ -0,0 +1,55 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+//go:build linux
+
+package gtss
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listen on unix socket, the socket file is created with given mode
+// masked by the umask, so there's no moment it has looser permissions.
+// Linux takes mode of the file from the socket inode, that is changed
+// before bind; the umask of the process is not touched
+func listenUnixMode(n, a string, mode os.FileMode) (net.Listener, error) {
+	debugf("listenUnixMode: %s, %s, %v", n, a, mode)
+	var lc = net.ListenConfig{
+		Control: func(_, _ string, rc syscall.RawConn) (err error) {
+			cerr := rc.Control(func(fd uintptr) {
+				err = syscall.Fchmod(int(fd), uint32(mode.Perm()))
+			})
+			if err == nil {
+				err = cerr
+			}
+			return
+		},
+	}
+	return lc.Listen(context.Background(), n, a)
+}
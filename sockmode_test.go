@@ -0,0 +1,57 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+//go:build linux
+
+package gtss
+
+import (
+	"testing"
+
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+func Test_listenUnixMode(t *testing.T) {
+	var umask = syscall.Umask(022)
+	defer syscall.Umask(umask)
+	sock := filepath.Join(t.TempDir(), "gtss.sock")
+	l, err := listenUnixMode("unix", sock, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 { // not chmod-ed
+		t.Errorf("wrong mode: %v", fi.Mode())
+	}
+	if umask := syscall.Umask(022); umask != 022 {
+		t.Errorf("umask is changed: %o", umask)
+	}
+}
@@ -0,0 +1,126 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// A ConnState represents the state of a client connection to a server.
+// It's used by the optional (*Server).ConnState hook
+type ConnState int32
+
+// connection states
+const (
+	// StateNew represents a new connection that just accepted
+	StateNew ConnState = iota
+	// StateActive represents a connection that handlers chain is
+	// started for or that has read some bytes
+	StateActive
+	// StateIdle represents a connection that waits for incoming data,
+	// i.e. (*Context).Read is called and read buffer is empty
+	StateIdle
+	// StateHijacked represents a hijacked connection. This is a
+	// terminal state, it does not transition to StateClosed
+	StateHijacked
+	// StateClosed represents a closed connection. This is a terminal
+	// state
+	StateClosed
+)
+
+var stateName = [...]string{
+	StateNew:      "new",
+	StateActive:   "active",
+	StateIdle:     "idle",
+	StateHijacked: "hijacked",
+	StateClosed:   "closed",
+}
+
+// String implements fmt.Stringer interface
+func (c ConnState) String() string {
+	if c >= 0 && int(c) < len(stateName) {
+		return stateName[c]
+	}
+	return "unknown"
+}
+
+// ErrHijacked is returned by Read, Write, Flush and Close methods
+// of hijacked Context
+var ErrHijacked = errors.New("connection has been hijacked")
+
+// set connection state and call the ConnState hook if the
+// state changed
+func (s *Server) setState(ctx *Context, state ConnState) {
+	if ConnState(atomic.SwapInt32(&ctx.state, int32(state))) == state &&
+		state != StateNew {
+		return // not changed
+	}
+	if hook := s.ConnState; hook != nil {
+		hook(ctx.Conn, state)
+	}
+}
+
+// State returns current state of the connection
+func (c *Context) State() ConnState {
+	debugf("(*Context).State: %v", c.RemoteAddr())
+	return ConnState(atomic.LoadInt32(&c.state))
+}
+
+// Hijack lets the caller take over the connection. After a call to
+// Hijack the server will not do anything else with the connection:
+// it's not closed after the chain and it's not killed by
+// (*Grace).Shutdown. The write buffer is flushed. The buffered is
+// data already read from the connection but not consumed yet. It's
+// the caller's responsibility to manage and close the connection.
+// Deadlines set by the server timeouts are cleared
+func (c *Context) Hijack() (conn net.Conn, buffered []byte, err error) {
+	debugf("(*Context).Hijack: %v", c.RemoteAddr())
+	if c.hijacked {
+		return nil, nil, ErrHijacked
+	}
+	if err = c.Flush(); err != nil {
+		return
+	}
+	if n := c.buffered(); n > 0 {
+		var p []byte
+		if p, err = c.peek(n); err != nil {
+			return
+		}
+		buffered = append([]byte(nil), p...)
+	}
+	if c.rt > 0 || c.wt > 0 || c.it > 0 {
+		if err = c.Conn.SetDeadline(time.Time{}); err != nil {
+			return // reset timeouts
+		}
+	}
+	c.hijacked = true
+	c.srv.trackContext(c, false)
+	c.srv.setState(c, StateHijacked)
+	return c.Conn, buffered, nil
+}
@@ -0,0 +1,125 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+func TestServer_ConnState(t *testing.T) {
+	data := []byte("Hello")
+
+	var (
+		mu     sync.Mutex
+		states []string
+		closed = make(chan struct{})
+	)
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    No,
+			ReadBufferSize:  Default,
+			WriteBufferSize: No,
+			Handlers:        []Handler{hRecv(data, t)},
+			ConnState: func(_ net.Conn, state ConnState) {
+				mu.Lock()
+				defer mu.Unlock()
+				states = append(states, state.String())
+				if state == StateClosed {
+					close(closed)
+				}
+			},
+		}
+	})
+	defer g.Close()
+	if err := send(ln.Addr().String(), data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection is not closed")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := "new active idle active closed"
+	if got := strings.Join(states, " "); got != want {
+		t.Errorf("wrong states: want %q, got %q", want, got)
+	}
+}
+
+func TestContext_Hijack(t *testing.T) {
+	data := []byte("Hello")
+	connc := make(chan net.Conn, 1)
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			Addr:            listenOn,
+			WorkersLimit:    No,
+			ReadBufferSize:  Default,
+			WriteBufferSize: Default,
+			Handlers: []Handler{
+				func(ctx *Context) {
+					if _, err := ctx.Read(make([]byte, 1)); err != nil {
+						t.Error("handler read error:", err)
+					}
+					conn, buffered, err := ctx.Hijack()
+					if err != nil {
+						t.Error("hijack error:", err)
+					}
+					if string(buffered) != string(data[1:]) {
+						t.Errorf("wrong buffered: %q", buffered)
+					}
+					if ctx.State() != StateHijacked {
+						t.Errorf("wrong state: %v", ctx.State())
+					}
+					if _, err := ctx.Write(data); err != ErrHijacked {
+						t.Errorf("unexpected write error: %v", err)
+					}
+					connc <- conn
+				},
+			},
+		}
+	})
+	defer g.Close()
+	if err := send(ln.Addr().String(), data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case conn := <-connc:
+		defer conn.Close()
+		time.Sleep(10 * time.Millisecond) // let the serve returns
+		if _, err := conn.Write(data); err != nil {
+			t.Error("hijacked connection is closed:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler is not called")
+	}
+}
@@ -0,0 +1,144 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// systemd socket activation environment variables
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+
+	listenFDsStart = 3 // SD_LISTEN_FDS_START
+)
+
+// sockets passed by systemd
+type systemdSockets struct {
+	once sync.Once
+	err  error
+	ls   map[string][]net.Listener
+	pcs  map[string][]net.PacketConn
+	all  []net.Listener
+}
+
+// sockets passed by systemd, they are loaded once
+var systemd systemdSockets
+
+// load sockets passed by systemd and unset the environment variables
+// to not pass them to child processes
+func loadSystemd() {
+	debugf("loadSystemd")
+	systemd.ls = make(map[string][]net.Listener)
+	systemd.pcs = make(map[string][]net.PacketConn)
+	fdsEnv := os.Getenv(envListenFDs)
+	if fdsEnv == "" {
+		return // not activated
+	}
+	pidEnv := os.Getenv(envListenPID)
+	namesEnv := os.Getenv(envListenFDNames)
+	if pidEnv == "" {
+		return // not activated, as sd_listen_fds does
+	}
+	pid, err := strconv.Atoi(pidEnv)
+	if err != nil {
+		systemd.err = fmt.Errorf("malformed %s: %q", envListenPID, pidEnv)
+		return
+	}
+	if pid != os.Getpid() {
+		return // for another process
+	}
+	os.Unsetenv(envListenPID)
+	os.Unsetenv(envListenFDs)
+	os.Unsetenv(envListenFDNames)
+	fds, err := strconv.Atoi(fdsEnv)
+	if err != nil || fds < 0 {
+		systemd.err = fmt.Errorf("malformed %s: %q", envListenFDs, fdsEnv)
+		return
+	}
+	var names []string
+	if namesEnv != "" {
+		names = strings.Split(namesEnv, ":")
+	}
+	for i := 0; i < fds; i++ {
+		var name = "unknown" // systemd default
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		if l, err := net.FileListener(f); err == nil {
+			systemd.ls[name] = append(systemd.ls[name], l)
+			systemd.all = append(systemd.all, l)
+		} else if pc, perr := net.FilePacketConn(f); perr == nil {
+			systemd.pcs[name] = append(systemd.pcs[name], pc)
+		} else {
+			systemd.err = fmt.Errorf("socket %d (%s): %v", listenFDsStart+i,
+				name, err)
+		}
+		f.Close() // the l or the pc holds its own copy
+		if systemd.err != nil {
+			return
+		}
+	}
+}
+
+// SystemdListeners returns listeners passed by systemd socket
+// activation (LISTEN_FDS, LISTEN_PID), in order of file descriptors.
+// It returns nil, nil if the process is not activated. The sockets
+// are loaded once, the environment variables are unset, and the same
+// listeners are returned by subsequent calls. Use (*Server).Serve or
+// (*Grace).ServeAll to serve them
+func SystemdListeners() (ls []net.Listener, err error) {
+	debugf("SystemdListeners")
+	systemd.once.Do(loadSystemd)
+	return systemd.all, systemd.err
+}
+
+// SystemdNamedListeners returns listeners passed by systemd socket
+// activation grouped by names (LISTEN_FDNAMES, FileDescriptorName= of
+// socket unit). A socket without a name is "unknown". Many sockets
+// can share the same name. See also SystemdListeners
+func SystemdNamedListeners() (ls map[string][]net.Listener, err error) {
+	debugf("SystemdNamedListeners")
+	systemd.once.Do(loadSystemd)
+	return systemd.ls, systemd.err
+}
+
+// SystemdPacketConns returns datagram sockets passed by systemd
+// socket activation grouped by names. Use (*PacketServer).Serve or
+// (*Grace).ServePacket to serve them. See also SystemdNamedListeners
+func SystemdPacketConns() (pcs map[string][]net.PacketConn, err error) {
+	debugf("SystemdPacketConns")
+	systemd.once.Do(loadSystemd)
+	return systemd.pcs, systemd.err
+}
@@ -0,0 +1,185 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+//go:build unix
+
+package gtss
+
+import (
+	"testing"
+
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+const envSystemdChild = "GTSS_TEST_SYSTEMD_CHILD"
+
+// the activated process, it serves until stdin closed
+func TestSystemdChild(t *testing.T) {
+	if os.Getenv(envSystemdChild) == "" {
+		t.Skip("not a child process")
+	}
+	named, err := SystemdNamedListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range []string{envListenPID, envListenFDs, envListenFDNames} {
+		if _, ok := os.LookupEnv(env); ok {
+			t.Errorf("%s is not unset", env)
+		}
+	}
+	all, err := SystemdListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || len(named["web"]) != 1 || len(named["admin"]) != 1 {
+		t.Fatalf("unexpected listeners: %v, %v", all, named)
+	}
+	pcs, err := SystemdPacketConns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pcs["dns"]) != 1 {
+		t.Fatalf("unexpected packet conns: %v", pcs)
+	}
+	var web, admin, dns Grace
+	web.ServeAll(&Server{
+		Handlers: []Handler{hName("web")},
+		ErrorLog: discardLogger(),
+	}, named["web"]...)
+	admin.ServeAll(&Server{
+		Handlers: []Handler{hName("admin")},
+		ErrorLog: discardLogger(),
+	}, named["admin"]...)
+	dns.ServePacket(&PacketServer{
+		Handlers: []PacketHandler{
+			func(ctx *PacketContext) { ctx.Write([]byte("dns")) },
+		},
+		ErrorLog: discardLogger(),
+	}, pcs["dns"][0])
+	io.Copy(io.Discard, os.Stdin)
+	web.Close()
+	admin.Close()
+	dns.Close()
+}
+
+// start the child as systemd does, the shell sets LISTEN_PID
+// to its own PID and replaces itself with the child
+func TestSystemdListeners(t *testing.T) {
+	if os.Getenv(envSystemdChild) != "" {
+		t.Skip("child process")
+	}
+	var (
+		files []*os.File
+		addrs []string
+	)
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files, addrs = append(files, f), append(addrs, l.Addr().String())
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	f, err := pc.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files = append(files, f)
+
+	cmd := exec.Command("/bin/sh", "-c", `LISTEN_PID=$$ exec "$0" "$@"`,
+		os.Args[0], "-test.run=^TestSystemdChild$")
+	cmd.Env = append(os.Environ(), envSystemdChild+"=1",
+		envListenFDs+"="+strconv.Itoa(len(files)),
+		envListenFDNames+"=web:admin:dns")
+	cmd.ExtraFiles = files
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range []string{"web", "admin"} {
+		conn, err := net.Dial("tcp", addrs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if who, err := ask(conn); err != nil || who != name+"\n" {
+			t.Errorf("unexpected reply of %s: %q, %v", name, who, err)
+		}
+		conn.Close()
+	}
+	if got := packetExchange(t, pc.LocalAddr(), []byte("?")); string(got) != "dns" {
+		t.Errorf("unexpected reply of dns: %q", got)
+	}
+
+	stdin.Close()
+	if err = cmd.Wait(); err != nil {
+		t.Errorf("child process: %v", err)
+	}
+}
+
+func Test_loadSystemd(t *testing.T) {
+	defer func() { systemd = systemdSockets{} }()
+	for _, tt := range []struct {
+		pid, fds string
+		err      bool
+	}{
+		{"", "", false},
+		{"1", "1", false}, // another process
+		{"", "1", false},  // no LISTEN_PID
+		{"x", "1", true},
+		{strconv.Itoa(os.Getpid()), "x", true},
+		{strconv.Itoa(os.Getpid()), "-1", true},
+	} {
+		systemd = systemdSockets{}
+		t.Setenv(envListenPID, tt.pid)
+		t.Setenv(envListenFDs, tt.fds)
+		ls, err := SystemdListeners()
+		if (err != nil) != tt.err {
+			t.Errorf("%s, %s: unexpected error %v", tt.pid, tt.fds, err)
+		}
+		if len(ls) != 0 {
+			t.Errorf("%s, %s: unexpected listeners %v", tt.pid, tt.fds, ls)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// ErrNotTCP is reported if the (*Server).TCP options are set, but
+// an accepted connection is not a *net.TCPConn, even after unwrapping
+var ErrNotTCP = errors.New("not a TCP connection")
+
+// TCPOptions are options of accepted TCP connections. Zero values
+// keep defaults of Go and the system
+type TCPOptions struct {
+	// KeepAlive is period of keep-alive probes, negative disables
+	// them. Go enables them by default
+	KeepAlive time.Duration
+	// Delay turns off TCP_NODELAY, that is set by Go by default, to
+	// enable Nagle's algorithm
+	Delay bool
+	// Linger sets SO_LINGER, it's rounded up to seconds. Negative
+	// discards unsent data and resets connection on close
+	Linger time.Duration
+	// RecvBuffer sets SO_RCVBUF
+	RecvBuffer int
+	// SendBuffer sets SO_SNDBUF
+	SendBuffer int
+	// UserTimeout sets TCP_USER_TIMEOUT, Linux only. It's maximum
+	// time transmitted data may remain unacknowledged
+	UserTimeout time.Duration
+}
+
+// check the options
+func (o *TCPOptions) check() (err error) {
+	debugf("(*TCPOptions).check")
+	switch {
+	case o.RecvBuffer < 0:
+		err = fmt.Errorf("negative (*Server).TCP.RecvBuffer: %d",
+			o.RecvBuffer)
+	case o.SendBuffer < 0:
+		err = fmt.Errorf("negative (*Server).TCP.SendBuffer: %d",
+			o.SendBuffer)
+	case o.UserTimeout < 0:
+		err = fmt.Errorf("negative (*Server).TCP.UserTimeout: %s",
+			o.UserTimeout)
+	}
+	return
+}
+
+// is any option set
+func (o *TCPOptions) isSet() bool {
+	return *o != TCPOptions{}
+}
+
+// apply the options to given connection, it returns ErrNotTCP if the
+// conn is not a *net.TCPConn after unwrapping
+func (o *TCPOptions) apply(conn net.Conn) (err error) {
+	debugf("(*TCPOptions).apply")
+	tc, ok := unwrapConn(conn).(*net.TCPConn)
+	if !ok {
+		return ErrNotTCP
+	}
+	if o.KeepAlive < 0 {
+		if err = tc.SetKeepAlive(false); err != nil {
+			return
+		}
+	} else if o.KeepAlive > 0 {
+		if err = tc.SetKeepAlive(true); err != nil {
+			return
+		}
+		if err = tc.SetKeepAlivePeriod(o.KeepAlive); err != nil {
+			return
+		}
+	}
+	if o.Delay {
+		if err = tc.SetNoDelay(false); err != nil {
+			return
+		}
+	}
+	if o.Linger < 0 {
+		err = tc.SetLinger(0)
+	} else if o.Linger > 0 {
+		err = tc.SetLinger(int((o.Linger + time.Second - 1) / time.Second))
+	}
+	if err != nil {
+		return
+	}
+	if o.RecvBuffer > 0 {
+		if err = tc.SetReadBuffer(o.RecvBuffer); err != nil {
+			return
+		}
+	}
+	if o.SendBuffer > 0 {
+		if err = tc.SetWriteBuffer(o.SendBuffer); err != nil {
+			return
+		}
+	}
+	if o.UserTimeout > 0 {
+		err = setUserTimeout(tc, o.UserTimeout)
+	}
+	return
+}
+
+// apply the (*Server).TCP options to accepted connection, the first
+// failure is logged as a warning, since it's likely the same for all
+// connections
+func (s *Server) tuneConn(conn net.Conn) {
+	debugf("(*Server).tuneConn")
+	if err := s.TCP.apply(conn); err != nil {
+		s.tcpWarn.Do(func() {
+			s.log(slog.LevelWarn, "TCP options have no effect",
+				"error", err, "conn_type", fmt.Sprintf("%T", conn))
+		})
+	}
+}
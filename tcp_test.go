@@ -0,0 +1,169 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+//go:build linux
+
+package gtss
+
+import (
+	"testing"
+
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// check options of accepted connection, the sockopts are read in
+// handler and the result is sent to the client
+func hCheckTCP(t *testing.T) Handler {
+	return func(ctx *Context) {
+		tc, ok := unwrapConn(ctx.Connection()).(*net.TCPConn)
+		if !ok {
+			t.Errorf("not a TCP connection: %T", ctx.Connection())
+			return
+		}
+		for _, opt := range []struct {
+			name       string
+			level, opt int
+			check      func(int) bool
+		}{
+			{"SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE,
+				func(v int) bool { return v == 1 }},
+			{"TCP_KEEPIDLE", syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE,
+				func(v int) bool { return v == 7 }},
+			{"TCP_NODELAY", syscall.IPPROTO_TCP, syscall.TCP_NODELAY,
+				func(v int) bool { return v == 0 }},
+			{"SO_RCVBUF", syscall.SOL_SOCKET, syscall.SO_RCVBUF,
+				func(v int) bool { return v >= 64*1024 }},
+			{"SO_SNDBUF", syscall.SOL_SOCKET, syscall.SO_SNDBUF,
+				func(v int) bool { return v >= 64*1024 }},
+			{"TCP_USER_TIMEOUT", syscall.IPPROTO_TCP, tcpUserTimeout,
+				func(v int) bool { return v == 3000 }},
+		} {
+			if v := getsockopt(t, tc, opt.level, opt.opt); !opt.check(v) {
+				t.Errorf("unexpected %s: %d", opt.name, v)
+			}
+		}
+		ctx.Write([]byte("ok"))
+	}
+}
+
+var testTCPOptions = TCPOptions{
+	KeepAlive:   7 * time.Second,
+	Delay:       true,
+	Linger:      5 * time.Second,
+	RecvBuffer:  64 * 1024,
+	SendBuffer:  64 * 1024,
+	UserTimeout: 3 * time.Second,
+}
+
+func TestServer_TCP(t *testing.T) {
+	var logs syncBuffer
+	g, ln := graceServe(t, func() *Server {
+		return &Server{
+			TCP:      testTCPOptions,
+			Handlers: []Handler{hCheckTCP(t)},
+			Logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+		}
+	})
+	defer g.Close()
+	if reply, err := recvAll(ln.Addr().String()); err != nil ||
+		string(reply) != "ok" {
+		t.Errorf("unexpected reply: %q, %v", reply, err)
+	}
+	if strings.Contains(logs.String(), "TCP options") {
+		t.Errorf("unexpected warning: %s", logs.String())
+	}
+}
+
+func TestServer_TCPOverTLS(t *testing.T) {
+	var g Grace
+	g.ServeAll(&Server{
+		TCP:      testTCPOptions,
+		Handlers: []Handler{hCheckTCP(t)},
+		ErrorLog: discardLogger(),
+	}, tls.NewListener(mustListen(t, "tcp", "127.0.0.1:0"), tlsConfig(t)))
+	defer g.Close()
+	conn, err := tls.Dial("tcp", g.ls[0].Addr().String(),
+		&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	var buf = make([]byte, 2)
+	if _, err = conn.Read(buf); err != nil || string(buf) != "ok" {
+		t.Errorf("unexpected reply: %q, %v", buf, err)
+	}
+}
+
+func TestServer_TCPNoEffect(t *testing.T) {
+	var (
+		logs syncBuffer
+		g    Grace
+		sock = filepath.Join(t.TempDir(), "gtss.sock")
+	)
+	g.ServeAll(&Server{
+		TCP:      TCPOptions{Delay: true},
+		Handlers: []Handler{func(ctx *Context) { ctx.Write([]byte("ok")) }},
+		Logger:   slog.New(slog.NewTextHandler(&logs, nil)),
+	}, mustListen(t, "unix", sock))
+	defer g.Close()
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		var buf = make([]byte, 2)
+		if _, err = conn.Read(buf); err != nil || string(buf) != "ok" {
+			t.Errorf("unexpected reply: %q, %v", buf, err)
+		}
+		conn.Close()
+	}
+	if n := strings.Count(logs.String(), "TCP options have no effect"); n != 1 {
+		t.Errorf("warning is logged %d times: %s", n, logs.String())
+	}
+	if !strings.Contains(logs.String(), ErrNotTCP.Error()) {
+		t.Errorf("missing reason: %s", logs.String())
+	}
+}
+
+func TestServer_TCPErrors(t *testing.T) {
+	for _, o := range []TCPOptions{
+		{RecvBuffer: -1},
+		{SendBuffer: -1},
+		{UserTimeout: -1},
+	} {
+		s := &Server{TCP: o}
+		if err := s.Serve(mustListen(t, "tcp", "127.0.0.1:0")); err == nil {
+			t.Errorf("missing error: %+v", o)
+		}
+	}
+}
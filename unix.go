@@ -0,0 +1,196 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// A UnixSocket represents mode and ownership of unix socket files.
+// It's not used for abstract sockets
+type UnixSocket struct {
+	// Mode is file mode of socket, if not zero. On Linux the socket
+	// file is created with the mode, thus it never has looser
+	// permissions; on other systems it's set after the file is created
+	Mode os.FileMode
+	// Chown turns on changing owner of socket to the UID and GID
+	Chown bool
+	// UID and GID of socket file, used if the Chown is true.
+	// Use No to keep one of them
+	UID, GID int
+}
+
+// A PeerCred represents credentials of process on the other side of
+// unix socket
+type PeerCred struct {
+	PID, UID, GID int
+}
+
+// ErrNotUnix is returned by (*Context).PeerCred for connections that
+// are not unix sockets
+var ErrNotUnix = errors.New("not a unix socket connection")
+
+func isUnixNet(n string) bool {
+	return n == "unix" || n == "unixpacket"
+}
+
+// abstract unix socket, Linux only
+func isAbstract(a string) bool {
+	return strings.HasPrefix(a, "@")
+}
+
+// remove socket file left by crashed server. The file is removed
+// only if it's a socket that nobody listens
+func removeStaleSocket(n, a string) (err error) {
+	debugf("removeStaleSocket: %s", a)
+	fi, err := os.Lstat(a)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return // not a socket, net.Listen fails
+	}
+	if c, err := net.Dial(n, a); err == nil {
+		c.Close()
+		return nil // alive, net.Listen fails
+	}
+	return os.Remove(a)
+}
+
+// listen on given network and address, unix socket
+// specific options are applied
+func (s *Server) listenOn(n, a string) (l net.Listener, err error) {
+	debugf("(*Server).listenOn: %s, %s", n, a)
+	return s.listenBind(n, a, a)
+}
+
+// listen on given network and bind address, where the a is configured
+// address, that is used to find inherited listener and can differ
+// from the bind address, for example, if port is zero
+func (s *Server) listenBind(n, a, bind string) (l net.Listener,
+	err error) {
+
+	debugf("(*Server).listenBind: %s, %s, %s", n, a, bind)
+	if l, err = takeInherited(n, a); l != nil || err != nil {
+		if err == nil {
+			l = keepListener(n, a, l)
+		}
+		return
+	}
+	defer func() {
+		if err == nil {
+			l = keepListener(n, a, l)
+		}
+	}()
+	if isTCPNet(n) {
+		return s.listenTCP(n, bind)
+	}
+	if !isUnixNet(n) || isAbstract(a) {
+		return net.Listen(n, a)
+	}
+	if err = removeStaleSocket(n, a); err != nil {
+		return
+	}
+	us := s.UnixSocket
+	if us.Mode != 0 {
+		l, err = listenUnixMode(n, a, us.Mode)
+	} else {
+		l, err = net.Listen(n, a)
+	}
+	if err != nil {
+		return
+	}
+	// the socket file is removed by the listener on Close
+	if us.Mode != 0 {
+		if err = os.Chmod(a, us.Mode); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("(*Server).UnixSocket.Mode: %v", err)
+		}
+	}
+	if us.Chown {
+		if err = os.Lchown(a, us.UID, us.GID); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("(*Server).UnixSocket.Chown: %v", err)
+		}
+	}
+	return
+}
+
+// unwrap connection, for example *tls.Conn, to get the
+// underlying one
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		nc, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = nc.NetConn()
+	}
+}
+
+// raw connection of accepted connection, only the limitConn is
+// unwrapped, since other wrappers, like *tls.Conn, can't be bypassed;
+// the connection must be exactly *net.TCPConn or *net.UnixConn, since
+// a wrapper embedding one of them gets its SyscallConn method, but can
+// change the data read
+func rawConn(conn net.Conn) (rc syscall.RawConn, ok bool) {
+	if lc, isLimit := conn.(*limitConn); isLimit {
+		conn = lc.Conn
+	}
+	var sc syscall.Conn
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		sc = c
+	case *net.UnixConn:
+		sc = c
+	default:
+		return
+	}
+	var err error
+	if rc, err = sc.SyscallConn(); err != nil {
+		return nil, false
+	}
+	return rc, true
+}
+
+// PeerCred returns credentials of peer process of unix socket
+// (SO_PEERCRED). It's supported on Linux only
+func (c *Context) PeerCred() (*PeerCred, error) {
+	debugf("(*Context).PeerCred: %v", c.RemoteAddr())
+	uc, ok := unwrapConn(c.Conn).(*net.UnixConn)
+	if !ok {
+		return nil, ErrNotUnix
+	}
+	return peerCred(uc)
+}
@@ -0,0 +1,134 @@
+//
+// Copyright (c) 2016 Konstantin Ivanov <kostyarin.ivanov@gmail.com>.
+// All rights reserved. This program is free software. It comes without
+// any warranty, to the extent permitted by applicable law. You can
+// redistribute it and/or modify it under the terms of the Do What
+// The Fuck You Want To Public License, Version 2, as published by
+// Sam Hocevar. See LICENSE file for more details or see below.
+//
+
+//
+//        DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//                    Version 2, December 2004
+//
+// Copyright (C) 2004 Sam Hocevar <sam@hocevar.net>
+//
+// Everyone is permitted to copy and distribute verbatim or modified
+// copies of this license document, and changing it is allowed as long
+// as the name is changed.
+//
+//            DO WHAT THE FUCK YOU WANT TO PUBLIC LICENSE
+//   TERMS AND CONDITIONS FOR COPYING, DISTRIBUTION AND MODIFICATION
+//
+//  0. You just DO WHAT THE FUCK YOU WANT TO.
+//
+
+package gtss
+
+import (
+	"testing"
+
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+func TestServer_listenOnUnix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "gtss.sock")
+	// stale socket file
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if _, err = os.Stat(sock); err != nil {
+		t.Fatal("missing stale socket:", err)
+	}
+	s := Server{UnixSocket: UnixSocket{Mode: 0600, Chown: true,
+		UID: No, GID: os.Getgid()}}
+	if l, err = s.listenOn("unix", sock); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("wrong mode: %v", fi.Mode())
+	}
+	// alive socket is not removed
+	if _, err := s.listenOn("unix", sock); err == nil {
+		t.Error("missing error")
+	}
+	l.Close()
+	if _, err = os.Stat(sock); !os.IsNotExist(err) {
+		t.Error("socket file is not removed:", err)
+	}
+	// not a socket is not removed
+	if err = ioutil.WriteFile(sock, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.listenOn("unix", sock); err == nil {
+		t.Error("missing error")
+	}
+}
+
+func TestContext_PeerCred(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("linux only")
+	}
+	credc := make(chan *PeerCred, 1)
+	s := &Server{
+		Listeners: []ListenerConfig{
+			{Net: "unix", Addr: "@gtss-test-" + time.Now().Format("150405.000000")},
+			{Addr: listenOn},
+		},
+		WorkersLimit:    No,
+		ReadBufferSize:  No,
+		WriteBufferSize: No,
+		Handlers: []Handler{
+			func(ctx *Context) {
+				pc, err := ctx.PeerCred()
+				if ctx.LocalAddr().Network() == "tcp" {
+					if err != ErrNotUnix {
+						t.Errorf("unexpected error: %v", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Error("peer credentials error:", err)
+				}
+				credc <- pc
+			},
+		},
+	}
+	var g Grace
+	g.ListenAndServeAll(s)
+	select {
+	case <-g.Done():
+		t.Fatal(g.Err())
+	default:
+	}
+	defer g.Close()
+	if err := send(g.ls[1].Addr().String(), nil); err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("unix", g.ls[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	select {
+	case pc := <-credc:
+		if pc.PID != os.Getpid() || pc.UID != os.Getuid() ||
+			pc.GID != os.Getgid() {
+			t.Errorf("wrong credentials: %+v", pc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler is not called")
+	}
+}